@@ -4,9 +4,7 @@ import (
 	"fmt"
 )
 
-func printBanner() {
-	fmt.Println(
-		`       ________
+var banner = `       ________
       /        \
      /          \
     /            \________
@@ -19,5 +17,8 @@ func printBanner() {
     \            /
      \          /
       \________/
-`)
+`
+
+func printBanner() {
+	fmt.Println(banner)
 }
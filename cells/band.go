@@ -2,18 +2,57 @@ package cells
 
 import (
 	"github.com/hlhv/fsock"
+	"github.com/hlhv/hlhv-queen/conf"
 	"github.com/hlhv/protocol"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+/* transport carries the frames of a band. Usually this is a connection of its
+ * own, but it may also be a stream on a multiplexed band.
+ */
+type transport interface {
+	readFrame() (kind protocol.FrameKind, data []byte, err error)
+	writeFrame(frame []byte) (nn int, err error)
+	setReadDeadline(deadline time.Time) error
+	close() error
+
+	// reserve waits until a frame may be written, and interrupt makes
+	// every reserve that is waiting, or that comes later, fail.
+	reserve(frame []byte) error
+	interrupt()
+}
+
+/* connTransport is a transport that has a connection all to itself.
+ */
+type connTransport struct {
+	conn   net.Conn
+	reader *fsock.Reader
+	writer *fsock.Writer
+}
+
 type Band struct {
-	conn     net.Conn
-	reader   *fsock.Reader
-	writer   *fsock.Writer
-	open     bool
-	lock     bool
-	lastUsed time.Time
+	transport transport
+
+	// open, lock, and lastUsed are read while walking the band list, but
+	// may be changed by whatever routine is using the band, so they are
+	// only ever accessed atomically. lastUsed is in unix nanoseconds.
+	open     int32
+	lock     int32
+	lastUsed int64
+
+	// if the cell multiplexes its bands, mux is set on each band that has
+	// a connection of its own, and parent is set on each stream carried
+	// by one of them.
+	mux    *muxBand
+	parent *Band
+
+	// writes may come from the request handler and from the routine
+	// watching for the client to go away at the same time
+	writeMutex sync.Mutex
+	cancelled  int32
 }
 
 func NewBand(
@@ -24,11 +63,16 @@ func NewBand(
 	band *Band,
 ) {
 	return &Band{
-		conn:   conn,
-		reader: reader,
-		writer: writer,
-		open:   true,
-		lock:   false,
+		transport: &connTransport{
+			conn:   conn,
+			reader: reader,
+			writer: writer,
+		},
+		open: 1,
+		lock: 0,
+		// count the band as used when it connects, so that it is not
+		// pruned before it has had a chance to be used
+		lastUsed: time.Now().UnixNano(),
 	}
 }
 
@@ -40,7 +84,7 @@ func (band *Band) ReadParseFrame() (
 	data []byte,
 	err error,
 ) {
-	kind, data, err = protocol.ReadParseFrame(band.reader)
+	kind, data, err = band.transport.readFrame()
 	if err != nil {
 		band.Close()
 	}
@@ -50,19 +94,101 @@ func (band *Band) ReadParseFrame() (
 /* WriteMarshalFrame marshals and writes a Frame.
  */
 func (band *Band) WriteMarshalFrame(frame protocol.Frame) (nn int, err error) {
-	nn, err = protocol.WriteMarshalFrame(band.writer, frame)
+	frameData, err := protocol.MarshalFrame(frame)
+	if err != nil {
+		return 0, err
+	}
+	return band.WriteFrame(frameData)
+}
+
+/* WriteFrame writes a raw frame. If the frame has to wait for the cell to be
+ * ready for it, that happens before the band is locked for writing, so that a
+ * cancel frame can always get through in the meantime.
+ */
+func (band *Band) WriteFrame(frame []byte) (nn int, err error) {
+	err = band.transport.reserve(frame)
+	if err == errWriteInterrupted {
+		return 0, err
+	}
+	if err != nil {
+		band.Close()
+		return 0, err
+	}
+
+	band.writeMutex.Lock()
+	defer band.writeMutex.Unlock()
+
+	nn, err = band.transport.writeFrame(frame)
 	if err != nil {
 		band.Close()
 	}
 	return
 }
 
+/* Cancel tells the cell that the request on this band is no longer wanted. If
+ * the cell understands cancel frames, it is sent one, and has until the timeout
+ * to finish the response so that the band can be used again. Otherwise, the
+ * band is closed.
+ */
+func (band *Band) Cancel(supported bool) {
+	if !atomic.CompareAndSwapInt32(&band.cancelled, 0, 1) {
+		return
+	}
+
+	if !supported {
+		band.Close()
+		return
+	}
+
+	// stop waiting to send anything more of the request
+	band.transport.interrupt()
+
+	_, err := band.WriteMarshalFrame(&frameCancel{})
+	if err != nil {
+		return
+	}
+	band.transport.setReadDeadline(time.Now().Add(
+		time.Duration(conf.GetTimeout()) * time.Second))
+}
+
+/* Cancelled returns whether the request on this band has been cancelled.
+ */
+func (band *Band) Cancelled() bool {
+	return atomic.LoadInt32(&band.cancelled) != 0
+}
+
+/* reset clears a cancellation, once the cell has finished the response.
+ */
+func (band *Band) reset() {
+	if atomic.CompareAndSwapInt32(&band.cancelled, 1, 0) {
+		band.transport.setReadDeadline(time.Time{})
+	}
+}
+
 /* Close marks the band as closed, and ensures that the underlying socket is
  * also closed.
  */
 func (band *Band) Close() {
-	band.open = false
-	band.conn.Close()
+	atomic.StoreInt32(&band.open, 0)
+	band.transport.close()
+}
+
+/* isOpen returns whether the band has not been closed yet.
+ */
+func (band *Band) isOpen() bool {
+	return atomic.LoadInt32(&band.open) == 1
+}
+
+/* touch marks the band as recently used.
+ */
+func (band *Band) touch() {
+	atomic.StoreInt64(&band.lastUsed, time.Now().UnixNano())
+}
+
+/* usedBefore returns whether the band was last used before the given time.
+ */
+func (band *Band) usedBefore(threshold time.Time) bool {
+	return atomic.LoadInt64(&band.lastUsed) < threshold.UnixNano()
 }
 
 /* TryLock attempts to lock the band, and returns whether it succeeded or not.
@@ -70,20 +196,63 @@ func (band *Band) Close() {
  * have to wait for a huge file download to complete before being given a band.
  */
 func (band *Band) TryLock() bool {
-	/* this will not cause a race condition, because only one routine is
-	 * allowed to walk the band list at any given moment.
-	 */
-	if band.lock {
-		return false
-	}
-	band.lock = true
-	return true
+	return atomic.CompareAndSwapInt32(&band.lock, 0, 1)
 }
 
 /* Unlock unlocks the band, opening it for new requests.
  */
 func (band *Band) Unlock() {
-	band.lock = false
+	band.reset()
+	atomic.StoreInt32(&band.lock, 0)
 	// mark band as recently used
-	band.lastUsed = time.Now()
+	band.touch()
+}
+
+/* available returns whether the band can take on another request.
+ */
+func (band *Band) available() bool {
+	if !band.isOpen() {
+		return false
+	}
+	if band.mux != nil {
+		return band.mux.available()
+	}
+	return atomic.LoadInt32(&band.lock) == 0
+}
+
+/* busy returns whether the band is carrying any requests.
+ */
+func (band *Band) busy() bool {
+	if band.mux != nil {
+		return band.mux.busy()
+	}
+	return atomic.LoadInt32(&band.lock) == 1
+}
+
+func (transport *connTransport) readFrame() (
+	kind protocol.FrameKind,
+	data []byte,
+	err error,
+) {
+	return protocol.ReadParseFrame(transport.reader)
 }
+
+func (transport *connTransport) writeFrame(frame []byte) (nn int, err error) {
+	return transport.writer.WriteFrame(frame)
+}
+
+func (transport *connTransport) setReadDeadline(deadline time.Time) error {
+	return transport.conn.SetReadDeadline(deadline)
+}
+
+func (transport *connTransport) close() error {
+	return transport.conn.Close()
+}
+
+/* A connection of its own can always be written to straight away.
+ */
+func (transport *connTransport) reserve(frame []byte) error {
+	return nil
+}
+
+func (transport *connTransport) interrupt() {}
@@ -0,0 +1,228 @@
+package cells
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hlhv/hlhv-queen/conf"
+	"github.com/hlhv/hlhv-queen/srvhttps"
+	"github.com/hlhv/protocol"
+	"github.com/hlhv/scribe"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrBodyTooLarge = errors.New("request body is larger than the cell allows")
+
+/* writeBodyToCell writes the http request body to the cell, in chunks of the
+ * configured size. If the cell asked for the body to be streamed, each chunk is
+ * only sent once the cell has given enough credit for it. If the cell sends its
+ * response head while we are waiting for credit, the rest of the body is not
+ * sent, and the head is returned so that the response can go ahead. If the body
+ * is larger than the cell allows, the client is sent a 413 response and the
+ * request is cancelled. If anything goes wrong, this function takes care of
+ * responding to the client and of leaving the band in a clean state, and
+ * returns an error.
+ */
+func writeBodyToCell(
+	res http.ResponseWriter,
+	req *http.Request,
+	cell *Cell,
+	band *Band,
+	resWant *frameResWant,
+) (
+	early *responseFrame,
+	err error,
+) {
+	scribe.PrintProgress(scribe.LogLevelDebug, "sending body to cell")
+
+	// streamed bodies have no limit unless the cell sets one
+	stream := resWant.Stream && cell.HasFeature(FeatureStreamBody)
+	limited := !stream || resWant.MaxSize > 0
+	credit := resWant.Window
+	lastKind := protocol.FrameKindHTTPResWant
+
+	// don't bother sending anything if we already know it is too much
+	if limited && req.ContentLength > int64(resWant.MaxSize) {
+		return nil, refuseBody(res, req, cell, band, lastKind)
+	}
+
+	bodyBuffer := make([]byte, conf.GetBodyChunkSize())
+	totalRead := 0
+	for {
+		// wait until the cell is ready for more
+		for stream && credit <= 0 {
+			scribe.PrintProgress(
+				scribe.LogLevelDebug,
+				"waiting for body credit")
+			var kind protocol.FrameKind
+			var data []byte
+			var more int
+			kind, data, err = band.ReadParseFrame()
+			if err == nil && kind == protocol.FrameKindHTTPResHead {
+				scribe.PrintInfo(
+					scribe.LogLevelDebug,
+					"cell responded before taking the",
+					"whole body")
+				return &responseFrame{kind: kind, data: data}, nil
+			}
+			if err == nil {
+				more, err = parseCredit(kind, data)
+			}
+			if err != nil {
+				if band.Cancelled() {
+					return nil, err
+				}
+				band.Close()
+				srvhttps.WriteBadGateway(res, req, err)
+				return nil, err
+			}
+			credit += more
+			lastKind = frameKindCredit
+		}
+
+		chunk := bodyBuffer
+		if stream && credit < len(chunk) {
+			chunk = chunk[:credit]
+		}
+
+		scribe.PrintProgress(scribe.LogLevelDebug, "reading body chunk")
+		bytesRead, readErr := req.Body.Read(chunk)
+
+		totalRead += bytesRead
+		if limited && totalRead > resWant.MaxSize {
+			return nil, refuseBody(res, req, cell, band, lastKind)
+		}
+
+		if bytesRead > 0 {
+			scribe.PrintProgress(
+				scribe.LogLevelDebug,
+				"writing body chunk of size", bytesRead)
+
+			_, err = band.WriteFrame(append(
+				[]byte{byte(protocol.FrameKindHTTPReqBody)},
+				chunk[:bytesRead]...,
+			))
+			if err == errWriteInterrupted {
+				return nil, err
+			}
+			if err != nil {
+				err = errors.New(fmt.Sprint(
+					"band closed abruptly: ", err))
+				srvhttps.WriteBadGateway(res, req, err)
+				return nil, err
+			}
+			credit -= bytesRead
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// the client is most likely gone, so there is nobody
+			// to respond to
+			abortRequest(cell, band, lastKind)
+			return nil, errors.New(fmt.Sprint(
+				"could not read request body: ", readErr))
+		}
+	}
+
+	// the request trailers are only known once the whole body is read
+	if cell.HasFeature(FeatureTrailers) && len(req.Trailer) > 0 {
+		scribe.PrintProgress(
+			scribe.LogLevelDebug,
+			"sending trailers to cell")
+		frame := &frameTrailers{Headers: make(map[string][]string)}
+		for key, values := range req.Trailer {
+			if len(values) > 0 {
+				frame.Headers[strings.ToLower(key)] = values
+			}
+		}
+		_, err = band.WriteMarshalFrame(frame)
+		if err != nil {
+			err = errors.New(fmt.Sprint(
+				"band closed abruptly: ", err))
+			srvhttps.WriteBadGateway(res, req, err)
+			return nil, err
+		}
+	}
+
+	// write end to cell
+	scribe.PrintProgress(scribe.LogLevelDebug, "sending end to cell")
+	_, err = band.WriteMarshalFrame(&protocol.FrameHTTPReqEnd{})
+	if err != nil {
+		err = errors.New(fmt.Sprint("band closed abruptly: ", err))
+		srvhttps.WriteBadGateway(res, req, err)
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+/* responseFrame is a frame of the response that was read ahead of time.
+ */
+type responseFrame struct {
+	kind protocol.FrameKind
+	data []byte
+}
+
+/* parseCredit parses a credit frame read from the band, and returns how many
+ * more bytes of body the cell is ready for.
+ */
+func parseCredit(kind protocol.FrameKind, data []byte) (credit int, err error) {
+	if kind != frameKindCredit {
+		return 0, errors.New(fmt.Sprint(
+			"band sent unknown code ", kind, ", expecting body credit"))
+	}
+
+	frame := frameCredit{}
+	err = json.Unmarshal(data, &frame)
+	if err != nil {
+		return 0, err
+	}
+
+	if frame.Bytes < 0 {
+		return 0, errors.New("band sent negative body credit")
+	}
+	return frame.Bytes, nil
+}
+
+/* refuseBody tells the client that its request body is too large, and cancels
+ * the request on the band.
+ */
+func refuseBody(
+	res http.ResponseWriter,
+	req *http.Request,
+	cell *Cell,
+	band *Band,
+	lastKind protocol.FrameKind,
+) (
+	err error,
+) {
+	scribe.PrintInfo(scribe.LogLevelDebug, "request body too large")
+	abortRequest(cell, band, lastKind)
+	srvhttps.WritePayloadTooLarge(res, req, ErrBodyTooLarge)
+	return ErrBodyTooLarge
+}
+
+/* abortRequest cancels the request on a band, and waits for the cell to finish
+ * it, given the kind of the last frame that was read from the band.
+ */
+func abortRequest(cell *Cell, band *Band, lastKind protocol.FrameKind) {
+	band.Cancel(cell.HasFeature(FeatureCancel))
+	if band.isOpen() {
+		finishCancelled(band, lastKind)
+	}
+}
+
+/* bodyLimit returns a description of how much request body a cell wants, for
+ * use in log messages.
+ */
+func bodyLimit(resWant *frameResWant) string {
+	if resWant.Stream && resWant.MaxSize <= 0 {
+		return "all of the"
+	}
+	return strconv.Itoa(resWant.MaxSize) + " bytes of"
+}
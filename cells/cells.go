@@ -12,14 +12,44 @@ import (
 	"github.com/hlhv/protocol"
 	"github.com/hlhv/scribe"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+/* retryAfter is how many seconds clients are told to wait before trying again
+ * when a cell cannot keep up.
+ */
+const retryAfter = 1
+
+var (
+	ErrBandTimeout   = errors.New("timed out waiting for a band")
+	ErrBandQueueFull = errors.New("too many requests waiting for a band")
+)
+
+/* counters keeps track of how often cells fail to provide bands.
+ */
+var counters struct {
+	bandTimeouts  uint64
+	bandQueueFull uint64
+}
+
+/* Stats describes how often requests could not be given a band.
+ */
+func Stats() (lines []string) {
+	return []string{
+		"band timeouts " + strconv.FormatUint(
+			atomic.LoadUint64(&counters.bandTimeouts), 10),
+		"band queue full " + strconv.FormatUint(
+			atomic.LoadUint64(&counters.bandQueueFull), 10),
+	}
+}
+
 /* Cell represents a connection to a cell server. It should only be created in
  * response to an incoming tls connection, using the Handle function.
  */
@@ -30,15 +60,40 @@ type Cell struct {
 
 	bands      *list.List
 	bandsMutex sync.Mutex
-	waitList   chan chan *Band
+	waitList   *list.List
+
+	// minBands and maxBands are set by the cell when it mounts, and are
+	// -1 if the cell wants the configured defaults. pending is how many
+	// bands have been asked for but have not connected yet, and needed is
+	// how many are yet to be asked for.
+	minBands int
+	maxBands int
+	pending  int
+	needed   int
+
+	mounts      map[string]struct{}
+	mountsMutex sync.Mutex
 
-	mount string
+	// rejected holds mounts that have been refused, until the cell is
+	// told about them
+	rejected []*frameMountReject
 
 	sigQueue chan Sig
+	done     chan struct{}
+
+	features  map[string]bool
+	heartbeat heartbeat
+	muxWindow int
 
 	key     string
 	uuid    string
+	name    string
 	onClean func(*Cell)
+
+	// identity is the name of the credential the cell logged in with, and
+	// credential is what its key was checked against
+	identity   string
+	credential string
 }
 
 func NewCell(
@@ -46,6 +101,10 @@ func NewCell(
 	reader *fsock.Reader,
 	writer *fsock.Writer,
 	uuidString string,
+	name string,
+	identity string,
+	credential string,
+	features []string,
 	onClean func(*Cell),
 ) (
 	cell *Cell,
@@ -53,16 +112,33 @@ func NewCell(
 	key := uuid.New()
 	keyString := key.String()
 
+	featureSet := make(map[string]bool)
+	for _, feature := range features {
+		featureSet[feature] = true
+	}
+
 	return &Cell{
 		leash:    leash,
 		Reader:   reader,
 		Writer:   writer,
 		bands:    list.New(),
-		waitList: make(chan chan *Band, 64),
+		mounts:   make(map[string]struct{}),
+		waitList: list.New(),
+		minBands: -1,
+		maxBands: -1,
 		sigQueue: make(chan Sig),
-		key:      keyString,
-		uuid:     uuidString,
-		onClean:  onClean,
+		done:     make(chan struct{}),
+		features: featureSet,
+		// there is no ping to answer yet
+		heartbeat: heartbeat{answered: true},
+		muxWindow: conf.GetMuxWindow(),
+		key:       keyString,
+		uuid:      uuidString,
+		name:      name,
+		onClean:   onClean,
+
+		identity:   identity,
+		credential: credential,
 	}
 }
 
@@ -108,25 +184,75 @@ func (cell *Cell) handleOneFrame(
 ) {
 	switch kind {
 	case protocol.FrameKindMount:
-		frame := protocol.FrameMount{}
+		frame := frameMount{}
 		err = json.Unmarshal(data, &frame)
 		if err != nil {
 			return err
 		}
 
-		// mount
+		options := srvhttps.MountOptions{
+			Version:      frame.Version,
+			Weight:       defaultWeight,
+			Affinity:     frame.Affinity,
+			AffinityName: frame.AffinityName,
+		}
+		if frame.Weight != nil {
+			options.Weight = *frame.Weight
+		}
+
 		pattern := frame.Host + frame.Path
-		err = cell.MountFunc(pattern, cell.HandleHTTP)
+		if !conf.CheckMount(cell.identity, pattern) {
+			cell.rejectMount(
+				frame.Host, frame.Path,
+				"was denied a mount on")
+			break
+		}
+
+		err = cell.setBandLimits(frame.MinBands, frame.MaxBands)
 		if err != nil {
 			return err
 		}
+
+		// mount
+		err = cell.MountFunc(pattern, options, cell.HandleHTTP)
+		if err != nil {
+			return err
+		}
+		scribe.PrintInfo(
+			scribe.LogLevelNormal,
+			"cell", cell.uuid, "with identity", cell.describeIdentity(),
+			"mounted on", pattern)
+
+		// open idle bands ahead of time, so that the first requests
+		// don't have to wait for them
+		cell.warm()
 		break
 
+	case frameKindPong:
+		if !cell.HasFeature(FeatureHeartbeat) {
+			return errors.New("cell sent pong without heartbeat")
+		}
+		return cell.handlePong(data)
+
 	case protocol.FrameKindUnmount:
+		frame := frameUnmount{}
+		if len(data) > 0 {
+			err = json.Unmarshal(data, &frame)
+			if err != nil {
+				return err
+			}
+		}
+
 		// unmount
-		cell.Unmount()
+		if frame.Host == "" && frame.Path == "" {
+			cell.UnmountAll()
+			break
+		}
+		err = cell.Unmount(frame.Host + frame.Path)
 		if err != nil {
-			return err
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"cell could not unmount:", err)
 		}
 		break
 
@@ -149,41 +275,191 @@ func (cell *Cell) Uuid() string {
 	return cell.uuid
 }
 
-/* MountFunc is, for now, a wrapper around HolaMux.MountFunc().
+/* Name returns the name the cell logged in with, if any.
+ */
+func (cell *Cell) Name() string {
+	return cell.name
+}
+
+/* Identity returns the name of the credential the cell logged in with. It is
+ * empty if the cell used the shared connKey.
+ */
+func (cell *Cell) Identity() string {
+	return cell.identity
+}
+
+/* Credential returns what the cell's key was checked against when it logged
+ * in.
+ */
+func (cell *Cell) Credential() string {
+	return cell.credential
+}
+
+/* describeIdentity returns the cell's identity in a form fit for logging.
+ */
+func (cell *Cell) describeIdentity() string {
+	if cell.identity == "" {
+		return "(connKey)"
+	}
+	return cell.identity
+}
+
+/* Kick disconnects the cell. Its mounts and bands are cleaned up as if it had
+ * gone away on its own.
+ */
+func (cell *Cell) Kick() {
+	cell.leash.Close()
+}
+
+/* MuxWindow returns how much data may be sent on each stream of the cell's
+ * bands before waiting for more credit, if they are multiplexed.
+ */
+func (cell *Cell) MuxWindow() int {
+	return cell.muxWindow
+}
+
+/* HasFeature returns whether the cell negotiated an optional feature when it
+ * logged in.
+ */
+func (cell *Cell) HasFeature(feature string) bool {
+	return cell.features[feature]
+}
+
+/* MountFunc is, for now, a wrapper around HolaMux.MountFunc(). A cell may be
+ * mounted on any number of patterns at once.
  */
 func (cell *Cell) MountFunc(
 	pattern string,
+	options srvhttps.MountOptions,
 	callback func(http.ResponseWriter, *http.Request),
 ) (
 	err error,
 ) {
-	err = srvhttps.MountFunc(pattern, callback)
+	cell.mountsMutex.Lock()
+	defer cell.mountsMutex.Unlock()
+
+	err = srvhttps.MountFunc(pattern, cell.uuid, options, callback)
 	if err != nil {
 		return err
 	}
 
 	// add to mounts
-	cell.mount = pattern
+	cell.mounts[pattern] = struct{}{}
 
 	return nil
 }
 
-/* Unmount is, for now, a wrapper around HolaMux.Unmount().
+/* Unmount is, for now, a wrapper around HolaMux.Unmount(). It only unmounts
+ * patterns that this cell owns.
  */
-func (cell *Cell) Unmount() (err error) {
-	if cell.mount == "" {
-		errors.New("cell is not mounted")
+func (cell *Cell) Unmount(pattern string) (err error) {
+	cell.mountsMutex.Lock()
+	defer cell.mountsMutex.Unlock()
+
+	if _, mounted := cell.mounts[pattern]; !mounted {
+		return errors.New("cell is not mounted on " + pattern)
 	}
 
-	err = srvhttps.Unmount(cell.mount)
+	err = srvhttps.Unmount(pattern, cell.uuid)
 	if err != nil {
 		return err
 	}
-	cell.mount = ""
+	delete(cell.mounts, pattern)
 
 	return nil
 }
 
+/* UnmountAll unmounts every pattern that this cell owns.
+ */
+func (cell *Cell) UnmountAll() {
+	cell.mountsMutex.Lock()
+	defer cell.mountsMutex.Unlock()
+
+	for pattern := range cell.mounts {
+		err := srvhttps.Unmount(pattern, cell.uuid)
+		if err != nil {
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"could not unmount cell:", err)
+		}
+		delete(cell.mounts, pattern)
+	}
+}
+
+/* EnforceMountPolicy unmounts every pattern the cell is no longer allowed to
+ * mount, and tells the cell about it.
+ */
+func (cell *Cell) EnforceMountPolicy() {
+	for _, pattern := range cell.Mounts() {
+		if conf.CheckMount(cell.identity, pattern) {
+			continue
+		}
+
+		err := cell.Unmount(pattern)
+		if err != nil {
+			continue
+		}
+
+		host, path := pattern, ""
+		index := strings.Index(pattern, "/")
+		if index >= 0 {
+			host, path = pattern[:index], pattern[index:]
+		}
+		cell.rejectMount(host, path, "lost its mount on")
+	}
+}
+
+/* rejectMount refuses a mount the cell is not allowed to make, writes an audit
+ * line to the log, and tells the cell about it if it negotiated the
+ * mountReject feature.
+ */
+func (cell *Cell) rejectMount(host string, path string, action string) {
+	pattern := host + path
+	scribe.PrintWarning(
+		scribe.LogLevelNormal,
+		"audit: cell "+cell.uuid+" with identity "+
+			cell.describeIdentity()+" "+action+" "+pattern)
+
+	if !cell.HasFeature(FeatureMountReject) {
+		return
+	}
+
+	cell.mountsMutex.Lock()
+	cell.rejected = append(cell.rejected, &frameMountReject{
+		Host: host,
+		Path: path,
+		Reason: "identity " + cell.describeIdentity() +
+			" may not mount on " + pattern,
+	})
+	cell.mountsMutex.Unlock()
+
+	cell.SendSig(SigMountReject)
+}
+
+/* takeRejected returns every refused mount the cell has not been told about
+ * yet.
+ */
+func (cell *Cell) takeRejected() (rejected []*frameMountReject) {
+	cell.mountsMutex.Lock()
+	defer cell.mountsMutex.Unlock()
+
+	rejected = cell.rejected
+	cell.rejected = nil
+	return rejected
+}
+
+/* Mounts returns a list of every pattern this cell is mounted on.
+ */
+func (cell *Cell) Mounts() (patterns []string) {
+	cell.mountsMutex.Lock()
+	defer cell.mountsMutex.Unlock()
+
+	for pattern := range cell.mounts {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
 /* HandleHTTP handles an http request directed at this cell. It selects a free
  * band, and then uses it to inform the cell of a new request and it pipes the
  * response back to the client.
@@ -210,12 +486,20 @@ func (cell *Cell) HandleHTTP(
 		cookies[key] = append(cookies[key], cookie.Value)
 	}
 
-	nPort, _ := strconv.Atoi(req.URL.Port())
+	// the concrete hostname the client asked for, even if the cell was
+	// mounted on an alias or a wildcard
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+		port = srvhttps.GetPort()
+	}
+	nPort, _ := strconv.Atoi(port)
+
 	frameHead := &protocol.FrameHTTPReqHead{
 		RemoteAddr: req.RemoteAddr,
 		Method:     req.Method,
-		Scheme:     req.URL.Scheme,
-		Host:       req.URL.Hostname(),
+		Scheme:     "https",
+		Host:       host,
 		Port:       nPort,
 		Path:       req.URL.Path,
 		Fragment:   req.URL.Fragment,
@@ -232,7 +516,7 @@ func (cell *Cell) HandleHTTP(
 
 	defer func() {
 		if band != nil {
-			band.Unlock()
+			cell.Release(band)
 		}
 	}()
 
@@ -240,67 +524,70 @@ func (cell *Cell) HandleHTTP(
 		return
 	}
 
+	// if the client goes away, tell the cell to stop
+	stopWatching := cell.watchCancel(req, band)
+	defer stopWatching()
+
 	// wait for cell response
 	scribe.PrintProgress(scribe.LogLevelDebug, "waiting for cell response")
-	kind, data, err := band.ReadParseFrame()
-	if err != nil {
-		band.Close()
-		scribe.PrintError(scribe.LogLevelError, err)
-		srvhttps.WriteBadGateway(res, req, err)
+	kind, data, ok := readResponseFrame(res, req, band)
+	if !ok {
 		return
 	}
 
 	// check if cell wants body first
 	if kind == protocol.FrameKindHTTPResWant {
-		resWant := &protocol.FrameHTTPResWant{}
+		resWant := &frameResWant{}
 		err = json.Unmarshal(data, resWant)
 		if err != nil {
+			band.Close()
 			scribe.PrintError(scribe.LogLevelError, err)
+			srvhttps.WriteBadGateway(res, req, err)
 			return
 		}
 
-		// write body to cell
+		// write body to cell. if the client expects to be told to
+		// continue before sending it, this is when it happens.
 		scribe.PrintInfo(
 			scribe.LogLevelDebug,
-			"cell wants "+strconv.Itoa(resWant.MaxSize)+
-				" bytes of request body")
+			"cell wants", bodyLimit(resWant), "request body")
 
-		err = writeBodyToCell(res, req, band, resWant.MaxSize)
+		var early *responseFrame
+		early, err = writeBodyToCell(res, req, cell, band, resWant)
 		if err != nil {
 			scribe.PrintError(scribe.LogLevelError, err)
 			return
 		}
 
-		// wait for data again
-		kind, data, err = band.ReadParseFrame()
-		if err != nil {
-			band.Close()
-			scribe.PrintError(scribe.LogLevelError, err)
-			srvhttps.WriteBadGateway(res, req, err)
-			return
+		// wait for data again, unless the cell already started
+		// responding
+		if early != nil {
+			kind, data = early.kind, early.data
+		} else {
+			kind, data, ok = readResponseFrame(res, req, band)
+			if !ok {
+				return
+			}
 		}
 	}
 
-	// read http head from cell
-	if kind != protocol.FrameKindHTTPResHead {
-		band.Close()
-		err = errors.New(fmt.Sprint(
-			"band sent unknown code ", kind, ", expecting response",
-			"head"))
-		scribe.PrintError(scribe.LogLevelError, err)
-		srvhttps.WriteBadGateway(res, req, err)
+	// read http head from cell, passing on any informational responses
+	// that come before it
+	resHead, ok := readResponseHead(res, req, cell, band, kind, data)
+	if !ok {
 		return
 	}
 
-	// parse head
-	resHead := &protocol.FrameHTTPResHead{}
-	err = json.Unmarshal(data, resHead)
-	if err != nil {
-		scribe.PrintError(scribe.LogLevelError, err)
+	// the cell may agree to switch protocols, if it knows how
+	if resHead.StatusCode == http.StatusSwitchingProtocols &&
+		cell.HasFeature(FeatureUpgrade) && isUpgrade(req) {
+		stopWatching()
+		openTunnel(res, req, band, resHead)
 		return
 	}
 
 	if resHead.StatusCode < 200 {
+		band.Close()
 		err = errors.New(fmt.Sprint(
 			"band sent bad status code ", resHead.StatusCode))
 		scribe.PrintError(scribe.LogLevelError, err)
@@ -319,7 +606,189 @@ func (cell *Cell) HandleHTTP(
 
 	// send response
 	res.WriteHeader(resHead.StatusCode)
-	writeBodyFromCell(res, req, band)
+	writeBodyFromCell(res, req, cell, band)
+}
+
+/* readResponseFrame reads the next frame of a response from a band. If the
+ * body was streamed, the cell may have given more credit than it turned out to
+ * need, so credit frames are skipped. If reading fails or the request has been
+ * cancelled, this function takes care of the client and the band, and returns
+ * false.
+ */
+func readResponseFrame(
+	res http.ResponseWriter,
+	req *http.Request,
+	band *Band,
+) (
+	kind protocol.FrameKind,
+	data []byte,
+	ok bool,
+) {
+	kind, data, err := band.ReadParseFrame()
+	for err == nil && kind == frameKindCredit {
+		kind, data, err = band.ReadParseFrame()
+	}
+
+	if err != nil {
+		if band.Cancelled() {
+			return kind, data, false
+		}
+		band.Close()
+		scribe.PrintError(scribe.LogLevelError, err)
+		srvhttps.WriteBadGateway(res, req, err)
+		return kind, data, false
+	}
+
+	if band.Cancelled() {
+		finishCancelled(band, kind)
+		return kind, data, false
+	}
+
+	return kind, data, true
+}
+
+/* readResponseHead parses the response head sent by a cell, starting with a
+ * frame that has already been read. Informational responses, such as 103 Early
+ * Hints, are passed on to the client as they arrive, until the cell sends a
+ * head with any other status. 100 Continue is never passed on, because the
+ * server sends it by itself once the request body is read. If something goes
+ * wrong, this function takes care of the client and the band, and returns
+ * false.
+ */
+func readResponseHead(
+	res http.ResponseWriter,
+	req *http.Request,
+	cell *Cell,
+	band *Band,
+	kind protocol.FrameKind,
+	data []byte,
+) (
+	resHead *protocol.FrameHTTPResHead,
+	ok bool,
+) {
+	for {
+		if kind != protocol.FrameKindHTTPResHead {
+			band.Close()
+			err := errors.New(fmt.Sprint(
+				"band sent unknown code ", kind,
+				", expecting response head"))
+			scribe.PrintError(scribe.LogLevelError, err)
+			srvhttps.WriteBadGateway(res, req, err)
+			return nil, false
+		}
+
+		// parse head
+		resHead = &protocol.FrameHTTPResHead{}
+		err := cell.unmarshalResHead(data, resHead)
+		if err != nil {
+			band.Close()
+			scribe.PrintError(scribe.LogLevelError, err)
+			srvhttps.WriteBadGateway(res, req, err)
+			return nil, false
+		}
+
+		if !isInformational(resHead.StatusCode) {
+			return resHead, true
+		}
+
+		if resHead.StatusCode != http.StatusContinue {
+			writeInformational(res, resHead)
+		}
+
+		kind, data, ok = readResponseFrame(res, req, band)
+		if !ok {
+			return nil, false
+		}
+	}
+}
+
+/* isInformational returns whether a status code belongs to an informational
+ * response that can be followed by another response. Switching protocols is not
+ * one of them, because nothing else follows it.
+ */
+func isInformational(statusCode int) bool {
+	return statusCode >= 100 && statusCode < 200 &&
+		statusCode != http.StatusSwitchingProtocols
+}
+
+/* writeInformational sends an informational response to the client. Its headers
+ * are removed again afterwards, so that they are not repeated in the final
+ * response.
+ */
+func writeInformational(
+	res http.ResponseWriter,
+	resHead *protocol.FrameHTTPResHead,
+) {
+	scribe.PrintProgress(
+		scribe.LogLevelDebug,
+		"sending informational response", resHead.StatusCode)
+
+	header := res.Header()
+	saved := make(http.Header)
+	for key, values := range resHead.Headers {
+		key = http.CanonicalHeaderKey(key)
+		if _, exists := saved[key]; !exists {
+			saved[key] = append([]string(nil), header.Values(key)...)
+		}
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+
+	res.WriteHeader(resHead.StatusCode)
+
+	for key, values := range saved {
+		if len(values) == 0 {
+			header.Del(key)
+		} else {
+			header[key] = values
+		}
+	}
+}
+
+/* watchCancel cancels the request on a band if the client goes away before the
+ * response is finished. It returns a function that stops watching, which must
+ * be called before the band is released, and may be called more than once.
+ */
+func (cell *Cell) watchCancel(req *http.Request, band *Band) (stop func()) {
+	finished := make(chan struct{})
+	exited := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		defer close(exited)
+		select {
+		case <-req.Context().Done():
+			scribe.PrintInfo(
+				scribe.LogLevelDebug,
+				"client went away, cancelling request")
+			band.Cancel(cell.HasFeature(FeatureCancel))
+		case <-finished:
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(finished) })
+		<-exited
+	}
+}
+
+/* finishCancelled reads and throws away what is left of a cancelled response,
+ * starting with a frame that has already been read, so that the band is left
+ * in a clean state. If the cell does not finish in time, the band is closed.
+ */
+func finishCancelled(band *Band, kind protocol.FrameKind) {
+	var err error
+	for kind != protocol.FrameKindHTTPResEnd {
+		kind, _, err = band.ReadParseFrame()
+		if err != nil {
+			scribe.PrintInfo(
+				scribe.LogLevelDebug,
+				"cancelled request did not finish in time")
+			return
+		}
+	}
+	scribe.PrintDone(scribe.LogLevelDebug, "cancelled request finished")
 }
 
 /* initiateHTTPRequest gets a band, and use it to send the request to the cell.
@@ -335,16 +804,23 @@ func initiateHTTPRequest(
 	err error,
 ) {
 	scribe.PrintProgress(scribe.LogLevelDebug, "sending header to cell")
+	frameData, err := cell.marshalReqHead(frameHead)
+	if err != nil {
+		scribe.PrintError(scribe.LogLevelError, err)
+		srvhttps.WriteBadGateway(res, req, err)
+		return nil, err
+	}
+
 	for {
 		band, err = cell.Provide()
 		if err != nil {
-			err = errors.New(fmt.Sprint("server overload:", err))
+			err = errors.New(fmt.Sprint("server overload: ", err))
 			scribe.PrintError(scribe.LogLevelError, err)
-			srvhttps.WriteServUnavail(res, req, err)
+			srvhttps.WriteServUnavailRetry(res, req, err, retryAfter)
 			return
 		}
 
-		_, err = band.WriteMarshalFrame(frameHead)
+		_, err = band.WriteFrame(frameData)
 		if err == nil {
 			break
 		}
@@ -358,18 +834,31 @@ func initiateHTTPRequest(
 	return
 }
 
-/* writeBodyFromCell pipes the response body from the cell to the client.
+/* writeBodyFromCell pipes the response body from the cell to the client. The
+ * response is flushed to the client whenever the cell sends a flush frame, and
+ * after every chunk of server-sent events. Once a response is being streamed
+ * like this, the write timeout only limits how long each chunk may take to
+ * write, and not the response as a whole.
  */
 func writeBodyFromCell(
 	res http.ResponseWriter,
 	req *http.Request,
+	cell *Cell,
 	band *Band,
 ) {
+	// server-sent events have to reach the client as soon as they are
+	// sent
+	mediaType, _, _ := mime.ParseMediaType(res.Header().Get("Content-Type"))
+	streaming := mediaType == "text/event-stream"
+	controller := http.NewResponseController(res)
 
 	scribe.PrintProgress(scribe.LogLevelDebug, "piping body from cell")
 	for {
 		kind, data, err := band.ReadParseFrame()
 		if err != nil {
+			if band.Cancelled() {
+				return
+			}
 			band.Close()
 			err = errors.New(fmt.Sprint(
 				"band closed abruptly: ", err))
@@ -385,6 +874,34 @@ func writeBodyFromCell(
 			return
 		}
 
+		if band.Cancelled() {
+			finishCancelled(band, kind)
+			return
+		}
+
+		if kind == frameKindFlush && cell.HasFeature(FeatureFlush) {
+			streaming = true
+			err = flushResponse(controller)
+			if err != nil {
+				scribe.PrintError(scribe.LogLevelError, err)
+				band.Cancel(cell.HasFeature(FeatureCancel))
+				if !band.isOpen() {
+					return
+				}
+			}
+			continue
+		}
+
+		if kind == frameKindTrailers && cell.HasFeature(FeatureTrailers) {
+			err = writeTrailers(res, data)
+			if err != nil {
+				band.Close()
+				scribe.PrintError(scribe.LogLevelError, err)
+				return
+			}
+			continue
+		}
+
 		if kind != protocol.FrameKindHTTPResBody {
 			band.Close()
 			err = errors.New(fmt.Sprint(
@@ -395,80 +912,75 @@ func writeBodyFromCell(
 			return
 		}
 
+		if streaming {
+			extendWriteDeadline(controller)
+		}
+
 		_, err = res.Write(data)
+		if err == nil && streaming {
+			err = flushResponse(controller)
+		}
 		if err != nil {
 			err = errors.New(fmt.Sprint(
 				"http request mysteriously died: ", err))
 			scribe.PrintError(scribe.LogLevelError, err)
-			return
+
+			// nobody is going to read the rest of the response
+			band.Cancel(cell.HasFeature(FeatureCancel))
+			if !band.isOpen() {
+				return
+			}
 		}
 	}
 }
 
-/* writeBodyToCell writes the http request body to the cell.
+/* writeTrailers sets the trailers sent by a cell on the response. They are sent
+ * to the client after the body.
  */
-func writeBodyToCell(
-	res http.ResponseWriter,
-	req *http.Request,
-	band *Band,
-	maxSize int,
-) (
-	err error,
-) {
-	scribe.PrintProgress(scribe.LogLevelDebug, "sending body to cell")
-
-	bodyBuffer := make([]byte, 1024)
-	totalRead := 0
-	limitReached := false
-	for !limitReached {
-		scribe.PrintProgress(scribe.LogLevelDebug, "reading body chunk")
-		bytesRead, err := req.Body.Read(bodyBuffer)
-		if err != nil {
-			break
-		}
+func writeTrailers(res http.ResponseWriter, data []byte) (err error) {
+	frame := frameTrailers{}
+	err = json.Unmarshal(data, &frame)
+	if err != nil {
+		return err
+	}
 
-		totalRead += bytesRead
-		if totalRead > maxSize {
-			scribe.PrintInfo(scribe.LogLevelDebug, "limit reached")
-			bytesRead -= totalRead - maxSize
-			if bytesRead < 0 {
-				bytesRead = 0
-			}
-			limitReached = true
+	for key, values := range frame.Headers {
+		for _, value := range values {
+			res.Header().Add(
+				http.TrailerPrefix+http.CanonicalHeaderKey(key),
+				value)
 		}
+	}
+	return nil
+}
 
-		scribe.PrintProgress(
-			scribe.LogLevelDebug,
-			"writing body chunk of size", bytesRead)
-
-		_, err = band.writer.WriteFrame(
-			append(
-				[]byte{byte(protocol.FrameKindHTTPReqBody)},
-				bodyBuffer[:bytesRead]...,
-			),
-		)
+/* flushResponse sends everything written to the response so far to the client.
+ */
+func flushResponse(controller *http.ResponseController) (err error) {
+	err = controller.Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
 
-		if err != nil {
-			band.Close()
-			err = errors.New(fmt.Sprint(
-				"band closed abruptly:", err))
-			srvhttps.WriteBadGateway(res, req, err)
-			return err
-		}
+/* extendWriteDeadline gives the response another timeoutWrite seconds to be
+ * written, counting from now.
+ */
+func extendWriteDeadline(controller *http.ResponseController) {
+	deadline := time.Time{}
+	timeoutWrite := conf.GetTimeoutWrite()
+	if timeoutWrite > 0 {
+		deadline = time.Now().Add(
+			time.Duration(timeoutWrite) * time.Second)
 	}
 
-	// write end to cell
-	scribe.PrintProgress(scribe.LogLevelDebug, "sending end to cell")
-	_, err = band.WriteMarshalFrame(&protocol.FrameHTTPReqEnd{})
+	err := controller.SetWriteDeadline(deadline)
 	if err != nil {
-		band.Close()
-		err = errors.New(fmt.Sprint("band closed abruptly: ", err))
-		scribe.PrintError(scribe.LogLevelError, err)
-		srvhttps.WriteBadGateway(res, req, err)
-		return err
+		scribe.PrintInfo(
+			scribe.LogLevelDebug,
+			"could not extend write deadline:", err)
 	}
-
-	return nil
 }
 
 /* Bind adds a band to the cell, and fulfils a pending request for more.
@@ -481,28 +993,74 @@ func (cell *Cell) Bind(band *Band, key string) (err error) {
 	}
 
 	cell.bandsMutex.Lock()
+	defer cell.bandsMutex.Unlock()
+
+	if cell.pending > 0 {
+		cell.pending--
+	}
+
+	_, max := cell.bandLimits()
+	open, _ := cell.countBands()
+	if open >= max {
+		return errors.New(fmt.Sprint(
+			"cell already has the maximum of ", max, " bands"))
+	}
+
+	// inform the band that it has been accepted, before anything else can
+	// be sent on it
+	_, err = band.WriteMarshalFrame(&protocol.FrameAccept{
+		Uuid: cell.uuid,
+	})
+	if err != nil {
+		return err
+	}
+
+	if cell.HasFeature(FeatureMux) {
+		newMuxBand(band, cell.muxWindow)
+	}
 	cell.bands.PushBack(band)
-	cell.bandsMutex.Unlock()
 
-	select {
-	case request := <-cell.waitList:
-		scribe.PrintInfo(
-			scribe.LogLevelDebug,
-			"found band request, fulfilling")
-		request <- band
-		break
-	default:
+	waiter := cell.waitList.Front()
+	if waiter == nil {
 		scribe.PrintInfo(
 			scribe.LogLevelDebug,
 			"no band requests to fulfill")
-		break
+		return nil
 	}
 
+	// lock the band before handing it over, so that nothing else can
+	// take it in the meantime
+	taken := take(band)
+	if taken == nil {
+		return nil
+	}
+	scribe.PrintInfo(
+		scribe.LogLevelDebug,
+		"found band request, fulfilling")
+	cell.waitList.Remove(waiter)
+	waiter.Value.(chan *Band) <- taken
+
+	return nil
+}
+
+/* take returns a band that can carry a request, and that nothing else will be
+ * given until it is released. For a multiplexed band, this is a new stream on
+ * it. It returns nil if the band cannot take on another request.
+ */
+func take(band *Band) (taken *Band) {
+	if band.mux != nil {
+		return band.mux.open()
+	}
+	if band.isOpen() && band.TryLock() {
+		return band
+	}
 	return nil
 }
 
 /* Provide returns an unlocked band that is not currently being used. If it
  * can't find one, it puts in a request for one and waits until it is available.
+ * If there are too many requests waiting already, or the wait takes longer than
+ * the band timeout, it gives up and returns an error.
  * The band must be manually re-locked after use! (except on error)
  */
 func (cell *Cell) Provide() (band *Band, err error) {
@@ -511,67 +1069,270 @@ func (cell *Cell) Provide() (band *Band, err error) {
 	cell.bandsMutex.Lock()
 	item := cell.bands.Front()
 	for item != nil {
-		band := item.Value.(*Band)
-		if band.open && band.TryLock() {
+		band := take(item.Value.(*Band))
+		if band != nil {
+			// keep enough idle bands around for the next request
+			signal := cell.topUp()
 			cell.bandsMutex.Unlock()
+			if signal {
+				cell.SendSig(SigNeedBand)
+			}
 			return band, nil
 		}
 		item = item.Next()
 	}
-	cell.bandsMutex.Unlock()
 
 	// else, put in a request for a new one and wait
-	// request the next band be sent to us
+	if cell.waitList.Len() >= conf.GetBandQueueDepth() {
+		cell.bandsMutex.Unlock()
+		atomic.AddUint64(&counters.bandQueueFull, 1)
+		return nil, ErrBandQueueFull
+	}
+
+	// request the next band be sent to us. the channel is buffered so
+	// that Bind never has to wait for us.
 	scribe.PrintInfo(scribe.LogLevelDebug, "new band needed")
-	request := make(chan *Band)
-	cell.waitList <- request
+	request := make(chan *Band, 1)
+	waiter := cell.waitList.PushBack(request)
+	signal := cell.topUp()
+	cell.bandsMutex.Unlock()
 	scribe.PrintInfo(scribe.LogLevelDebug, "request made")
-	// send a request to the cell for a new band
-	cell.SendSig(SigNeedBand)
+
+	// send a request to the cell for new bands. if the cell already has
+	// as many as it is allowed, we wait for one to be released instead.
+	if signal {
+		cell.SendSig(SigNeedBand)
+	}
+
 	// wait for request to be fulfilled
 	scribe.PrintProgress(scribe.LogLevelDebug, "waiting for fulfill")
-	band = <-request
-	scribe.PrintDone(scribe.LogLevelDebug, "band request fulfilled")
+	timeout := time.NewTimer(
+		time.Duration(conf.GetBandTimeout()) * time.Second)
+	defer timeout.Stop()
+
+	select {
+	case band = <-request:
+	case <-timeout.C:
+		cell.bandsMutex.Lock()
+		cell.waitList.Remove(waiter)
+		cell.bandsMutex.Unlock()
+
+		// a band might have been handed over just before the request
+		// was withdrawn
+		select {
+		case band = <-request:
+		default:
+			atomic.AddUint64(&counters.bandTimeouts, 1)
+			return nil, ErrBandTimeout
+		}
+	}
 
 	if band == nil {
-		return nil, errors.New(
-			"internal communication bandwidth exceeded")
+		return nil, errors.New("cell disconnected")
 	}
 
+	scribe.PrintDone(scribe.LogLevelDebug, "band request fulfilled")
 	return band, nil
 }
 
-/* Prune removes bands that haven't been used in a while, or have been marked as
- * closed.
+/* Release unlocks a band after a request is done with it. If another request
+ * is waiting for a band, it is handed over directly instead. If the band is a
+ * stream on a multiplexed band, the stream is closed, and the waiting request
+ * is given a new one.
  */
-func (cell *Cell) Prune() (pruned int) {
+func (cell *Cell) Release(band *Band) {
 	cell.bandsMutex.Lock()
-	defer cell.bandsMutex.Unlock()
+	defer func() {
+		signal := cell.topUp()
+		cell.bandsMutex.Unlock()
+		if signal {
+			cell.SendSig(SigNeedBand)
+		}
+	}()
+
+	// a stream is never used again once its request is done, but the
+	// band carrying it now has room for another one
+	if band.parent != nil {
+		band.Close()
+		band = band.parent
+	}
+
+	waiter := cell.waitList.Front()
+	if !band.isOpen() || waiter == nil {
+		if band.mux == nil {
+			band.Unlock()
+		}
+		return
+	}
+
+	if band.mux == nil {
+		band.reset()
+		band.touch()
+	} else {
+		band = band.mux.open()
+		if band == nil {
+			return
+		}
+	}
+
+	scribe.PrintInfo(
+		scribe.LogLevelDebug,
+		"handing released band to waiting request")
+	cell.waitList.Remove(waiter)
+	waiter.Value.(chan *Band) <- band
+}
 
+/* Prune removes bands that haven't been used in a while, or have been marked as
+ * closed. It leaves at least the minimum number of idle bands open, and asks
+ * for more if there are not enough.
+ */
+func (cell *Cell) Prune() (pruned int) {
 	maxBandAge := time.Duration(conf.GetMaxBandAge()) * time.Second
+	threshold := time.Now().Add(-1 * maxBandAge)
 
-	now := time.Now()
-	threshold := now.Add(-1 * maxBandAge)
+	cell.bandsMutex.Lock()
+	min, _ := cell.bandLimits()
+	_, idle := cell.countBands()
 
 	item := cell.bands.Front()
 	for item != nil {
 		band := item.Value.(*Band)
+		next := item.Next()
 
-		if band.lastUsed.Before(threshold) {
+		if band.isOpen() && !band.busy() &&
+			band.usedBefore(threshold) && idle > min {
 			band.Close()
+			idle--
 		}
 
-		if !band.open {
+		if !band.isOpen() {
 			cell.bands.Remove(item)
 			pruned++
 		}
 
-		item = item.Next()
+		item = next
+	}
+
+	// bands that were asked for a while ago and never showed up are
+	// not coming
+	cell.pending = 0
+	signal := cell.topUp()
+	cell.bandsMutex.Unlock()
+
+	if signal {
+		cell.SendSig(SigNeedBand)
 	}
+	return
+}
+
+/* warm asks the cell for enough bands to reach its minimum number of idle
+ * bands.
+ */
+func (cell *Cell) warm() {
+	cell.bandsMutex.Lock()
+	signal := cell.topUp()
+	cell.bandsMutex.Unlock()
 
+	if signal {
+		cell.SendSig(SigNeedBand)
+	}
+}
+
+/* topUp works out how many more bands are needed to serve every waiting
+ * request and still have the minimum number of idle bands left over, without
+ * going over the maximum. It adds them to the amount that is yet to be asked
+ * for, and returns true if a SigNeedBand should be sent. It must only be called
+ * while bandsMutex is held.
+ */
+func (cell *Cell) topUp() (signal bool) {
+	min, max := cell.bandLimits()
+	open, idle := cell.countBands()
+
+	count := min + cell.waitList.Len() - idle - cell.pending
+	room := max - open - cell.pending
+	if count > room {
+		count = room
+	}
+	if count <= 0 {
+		return false
+	}
+
+	cell.pending += count
+	cell.needed += count
+	return true
+}
+
+/* takeNeeded returns how many bands should be asked for, and resets the count.
+ */
+func (cell *Cell) takeNeeded() (count int) {
+	cell.bandsMutex.Lock()
+	defer cell.bandsMutex.Unlock()
+
+	count = cell.needed
+	cell.needed = 0
+	return count
+}
+
+/* countBands returns how many of the cell's bands are open, and how many of
+ * those can take on another request. It must only be called while bandsMutex is
+ * held.
+ */
+func (cell *Cell) countBands() (open int, idle int) {
+	for item := cell.bands.Front(); item != nil; item = item.Next() {
+		band := item.Value.(*Band)
+		if !band.isOpen() {
+			continue
+		}
+		open++
+		if band.available() {
+			idle++
+		}
+	}
+	return
+}
+
+/* bandLimits returns the minimum number of idle bands the cell should have, and
+ * the maximum number of bands it may have in total. Limits given by the cell
+ * take precedence over the ones in the config file. It must only be called
+ * while bandsMutex is held.
+ */
+func (cell *Cell) bandLimits() (min int, max int) {
+	min = cell.minBands
+	if min < 0 {
+		min = conf.GetMinBands()
+	}
+	max = cell.maxBands
+	if max < 0 {
+		max = conf.GetMaxBands()
+	}
+	if min > max {
+		min = max
+	}
 	return
 }
 
+/* setBandLimits sets the band limits requested by the cell. Limits that are
+ * nil are left as they are.
+ */
+func (cell *Cell) setBandLimits(min *int, max *int) (err error) {
+	cell.bandsMutex.Lock()
+	defer cell.bandsMutex.Unlock()
+
+	if min != nil {
+		if *min < 0 {
+			return errors.New("cell asked for a negative minimum of bands")
+		}
+		cell.minBands = *min
+	}
+	if max != nil {
+		if *max < 1 {
+			return errors.New("cell asked for a maximum of less than 1 band")
+		}
+		cell.maxBands = *max
+	}
+	return nil
+}
+
 /* cleanUp should be called when the leash closes, and only when the leash
  * closes. It calls the externally specified cleanup function (which should
  * remove the cell from a server-wide cell list), unmounts the cell, and shuts
@@ -583,9 +1344,18 @@ func (cell *Cell) cleanUp() {
 
 	// stop listening for signals
 	cell.SendSig(SigCleaning)
+	close(cell.done)
+
+	// nothing is going to fulfill pending band requests anymore
+	cell.bandsMutex.Lock()
+	for waiter := cell.waitList.Front(); waiter != nil; waiter = waiter.Next() {
+		waiter.Value.(chan *Band) <- nil
+	}
+	cell.waitList.Init()
+	cell.bandsMutex.Unlock()
 
 	// unmount
-	cell.Unmount()
+	cell.UnmountAll()
 
 	// close all bands immediately
 	cell.bandsMutex.Lock()
@@ -0,0 +1,251 @@
+package cells
+
+import "github.com/hlhv/protocol"
+
+/* These frames extend the ones defined in the protocol package. Fields are
+ * only ever added, so cells that do not know about them keep working.
+ */
+
+/* These frame kinds are not part of the protocol package, and are only ever
+ * sent to cells that asked for the feature they belong to.
+ */
+const (
+	frameKindPing protocol.FrameKind = 0x40
+	frameKindPong protocol.FrameKind = 0x41
+
+	frameKindCancel protocol.FrameKind = 0x42
+	frameKindCredit protocol.FrameKind = 0x43
+	frameKindFlush  protocol.FrameKind = 0x44
+
+	// once a cell has answered a request to switch protocols with status
+	// 101, only tunnel frames are sent on the band. data frames carry raw
+	// bytes of the upgraded connection in either direction.
+	frameKindTunnelData  protocol.FrameKind = 0x45
+	frameKindTunnelClose protocol.FrameKind = 0x46
+
+	frameKindTrailers protocol.FrameKind = 0x47
+
+	frameKindWindow      protocol.FrameKind = 0x48
+	frameKindStreamReset protocol.FrameKind = 0x49
+
+	frameKindMountReject protocol.FrameKind = 0x4A
+)
+
+/* Features are optional parts of the protocol. A cell lists the ones it
+ * understands when it logs in, and the queen replies with the ones it will use.
+ */
+const (
+	// FeatureHeartbeat makes the queen ping the cell on its leash
+	FeatureHeartbeat = "heartbeat"
+	// FeatureCancel makes the queen tell the cell when a client goes
+	// away in the middle of a request
+	FeatureCancel = "cancel"
+	// FeatureStreamBody lets the cell pull the request body a piece at a
+	// time, by giving the queen credit
+	FeatureStreamBody = "streamBody"
+	// FeatureFlush lets the cell make the queen send what it has of the
+	// response to the client straight away
+	FeatureFlush = "flush"
+	// FeatureUpgrade lets the cell accept requests to switch protocols,
+	// such as websockets
+	FeatureUpgrade = "upgrade"
+	// FeatureTrailers lets trailers be sent after request and response
+	// bodies
+	FeatureTrailers = "trailers"
+	// FeatureMux makes every band the cell connects carry many requests
+	// at once
+	FeatureMux = "mux"
+	// FeatureBinaryHeads makes request and response heads use a compact
+	// binary encoding instead of JSON
+	FeatureBinaryHeads = "binaryHeads"
+	// FeatureMountReject makes the queen tell the cell when one of its
+	// mounts is refused or taken away
+	FeatureMountReject = "mountReject"
+)
+
+/* supportedFeatures lists every feature the queen understands.
+ */
+var supportedFeatures = []string{
+	FeatureHeartbeat,
+	FeatureCancel,
+	FeatureStreamBody,
+	FeatureFlush,
+	FeatureUpgrade,
+	FeatureTrailers,
+	FeatureMux,
+	FeatureBinaryHeads,
+	FeatureMountReject,
+}
+
+/* FrameIAm is sent from the client cell to the queen in order to initiate a
+ * connection. A cell may list the optional features it understands.
+ */
+type FrameIAm struct {
+	protocol.FrameIAm
+	Features []string `json:"features,omitempty"`
+
+	// Name is an optional name for the cell, used to find it through the
+	// control socket. Several cells may share the same name.
+	Name string `json:"name,omitempty"`
+}
+
+/* FrameAccept is sent from the queen to the client cell when it has been
+ * accepted. It lists the features the queen agreed to use.
+ */
+type FrameAccept struct {
+	protocol.FrameAccept
+	Features []string `json:"features,omitempty"`
+
+	// MuxWindow is how much data may be sent on each stream of a
+	// multiplexed band before waiting for more credit, in either direction
+	MuxWindow int `json:"muxWindow,omitempty"`
+}
+
+/* frameResWant is sent from the client cell to the queen as a request for the
+ * HTTP request body. If the cell negotiated the streamBody feature, it may ask
+ * for the body to be streamed, in which case the queen only sends as many bytes
+ * as the cell has given credit for, starting with the window. When streaming, a
+ * MaxSize of zero means there is no limit.
+ */
+type frameResWant struct {
+	protocol.FrameHTTPResWant
+	Stream bool `json:"stream"`
+	Window int  `json:"window"`
+}
+
+/* frameCredit is sent from the client cell to the queen while a request body is
+ * being streamed, and allows the queen to send that many more bytes of it.
+ */
+type frameCredit struct {
+	Bytes int `json:"bytes"`
+}
+
+/* framePing is sent from the queen to the client cell on its leash, and the
+ * cell must answer with a framePong carrying the same id.
+ */
+type framePing struct {
+	Id uint64 `json:"id"`
+}
+
+type framePong struct {
+	Id uint64 `json:"id"`
+}
+
+/* frameCancel is sent from the queen to the client cell on a band when the
+ * client that made the request has gone away. The cell should stop working on
+ * the request and send FrameHTTPResEnd as soon as it can, so that the band can
+ * be used again. If it arrives after the response has already been finished,
+ * the cell should ignore it.
+ */
+type frameCancel struct{}
+
+/* frameFlush is sent from the client cell to the queen between response body
+ * frames, and makes the queen send everything it has of the response to the
+ * client immediately.
+ */
+type frameFlush struct{}
+
+/* frameTunnelClose is sent in either direction when one side of an upgraded
+ * connection has closed it. The band is closed afterwards.
+ */
+type frameTunnelClose struct{}
+
+/* frameTrailers carries trailers. It is sent from the queen to the client cell
+ * after the request body and before FrameHTTPReqEnd, if the client sent any,
+ * and from the client cell to the queen after the response body and before
+ * FrameHTTPResEnd. Like in the request head, keys sent by the queen are
+ * lowercase.
+ */
+type frameTrailers struct {
+	Headers map[string][]string `json:"headers"`
+}
+
+/* frameWindow is sent in either direction on a stream of a multiplexed band,
+ * and gives the other side credit to send that many more bytes of body or
+ * tunnel data on the stream.
+ */
+type frameWindow struct {
+	Bytes int `json:"bytes"`
+}
+
+/* frameStreamReset is sent in either direction on a stream of a multiplexed
+ * band to abandon the request it carries. Nothing more is sent on the stream
+ * afterwards.
+ */
+type frameStreamReset struct{}
+
+/* frameMountReject is sent to the cell on its leash when it tries to mount a
+ * pattern it is not allowed to. The cell stays connected, and its other mounts
+ * are not affected.
+ */
+type frameMountReject struct {
+	Host   string `json:"host"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func (frame *framePing) Kind() protocol.FrameKind   { return frameKindPing }
+func (frame *framePong) Kind() protocol.FrameKind   { return frameKindPong }
+func (frame *frameCancel) Kind() protocol.FrameKind { return frameKindCancel }
+func (frame *frameCredit) Kind() protocol.FrameKind { return frameKindCredit }
+func (frame *frameFlush) Kind() protocol.FrameKind  { return frameKindFlush }
+func (frame *frameTrailers) Kind() protocol.FrameKind {
+	return frameKindTrailers
+}
+func (frame *frameWindow) Kind() protocol.FrameKind {
+	return frameKindWindow
+}
+func (frame *frameStreamReset) Kind() protocol.FrameKind {
+	return frameKindStreamReset
+}
+func (frame *frameMountReject) Kind() protocol.FrameKind {
+	return frameKindMountReject
+}
+func (frame *frameTunnelClose) Kind() protocol.FrameKind {
+	return frameKindTunnelClose
+}
+
+/* Negotiate returns the features out of the ones a cell asked for that the
+ * queen supports.
+ */
+func Negotiate(requested []string) (accepted []string) {
+	for _, feature := range requested {
+		for _, supported := range supportedFeatures {
+			if feature == supported {
+				accepted = append(accepted, feature)
+				break
+			}
+		}
+	}
+	return accepted
+}
+
+/* frameUnmount is sent from the client cell to the queen. If it specifies a
+ * host and path, only that mount is removed. If it is empty, every mount the
+ * cell owns is removed.
+ */
+type frameUnmount struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+}
+
+/* frameMount is sent from the client cell to the queen. On top of the host and
+ * path, it may give the version of the cell and the share of traffic that
+ * version should receive relative to other versions mounted on the same
+ * pattern. If the weight is left out, it defaults to defaultWeight. It may
+ * also ask for requests from the same client to be kept on the same cell, and
+ * override the number of bands the queen keeps open to it.
+ */
+type frameMount struct {
+	protocol.FrameMount
+	Version string `json:"version"`
+	Weight  *int   `json:"weight"`
+
+	Affinity     string `json:"affinity"`
+	AffinityName string `json:"affinityName"`
+
+	MinBands *int `json:"minBands"`
+	MaxBands *int `json:"maxBands"`
+}
+
+const defaultWeight = 100
@@ -0,0 +1,154 @@
+package cells
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hlhv/protocol"
+)
+
+var errHeadTruncated = errors.New("binary head ends too early")
+
+/* Request and response heads are sent as JSON, unless the cell negotiated
+ * FeatureBinaryHeads. Then, they are sent in a compact binary form instead,
+ * which is much cheaper to encode and decode. The frame kinds stay the same.
+ *
+ * A binary head is a list of fields, in the order they are declared in the
+ * protocol package, with nothing in between:
+ *
+ *	integer: a signed varint
+ *	string:  an unsigned varint length, followed by that many bytes
+ *	map:     an unsigned varint number of keys, followed by each key as a
+ *	         string, an unsigned varint number of values, and each value as
+ *	         a string
+ */
+
+/* marshalReqHead encodes a request head frame in the format the cell asked
+ * for.
+ */
+func (cell *Cell) marshalReqHead(
+	frame *protocol.FrameHTTPReqHead,
+) (
+	frameData []byte,
+	err error,
+) {
+	if !cell.HasFeature(FeatureBinaryHeads) {
+		return protocol.MarshalFrame(frame)
+	}
+
+	frameData = []byte{byte(frame.Kind())}
+	frameData = appendHeadString(frameData, frame.RemoteAddrReal)
+	frameData = appendHeadString(frameData, frame.RemoteAddr)
+	frameData = appendHeadString(frameData, frame.Method)
+	frameData = appendHeadString(frameData, frame.Scheme)
+	frameData = appendHeadString(frameData, frame.Host)
+	frameData = binary.AppendVarint(frameData, int64(frame.Port))
+	frameData = appendHeadString(frameData, frame.Path)
+	frameData = appendHeadString(frameData, frame.Fragment)
+	frameData = appendHeadMap(frameData, frame.Query)
+	frameData = appendHeadString(frameData, frame.Proto)
+	frameData = binary.AppendVarint(frameData, int64(frame.ProtoMajor))
+	frameData = binary.AppendVarint(frameData, int64(frame.ProtoMinor))
+	frameData = appendHeadMap(frameData, frame.Headers)
+	frameData = appendHeadMap(frameData, frame.Cookies)
+	return frameData, nil
+}
+
+/* unmarshalResHead decodes a response head frame in the format the cell asked
+ * for.
+ */
+func (cell *Cell) unmarshalResHead(
+	data []byte,
+	frame *protocol.FrameHTTPResHead,
+) (
+	err error,
+) {
+	if !cell.HasFeature(FeatureBinaryHeads) {
+		return json.Unmarshal(data, frame)
+	}
+
+	decoder := headDecoder{data: data}
+	frame.StatusCode = decoder.int()
+	frame.Headers = decoder.stringMap()
+	if decoder.err == nil && len(decoder.data) > 0 {
+		return errors.New("binary head has extra data at the end")
+	}
+	return decoder.err
+}
+
+func appendHeadString(data []byte, value string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func appendHeadMap(data []byte, values map[string][]string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(values)))
+	for key, list := range values {
+		data = appendHeadString(data, key)
+		data = binary.AppendUvarint(data, uint64(len(list)))
+		for _, value := range list {
+			data = appendHeadString(data, value)
+		}
+	}
+	return data
+}
+
+/* headDecoder reads fields from a binary head. Once it runs into an error, it
+ * stops reading, and every field after that is empty.
+ */
+type headDecoder struct {
+	data []byte
+	err  error
+}
+
+func (decoder *headDecoder) length() int {
+	if decoder.err != nil {
+		return 0
+	}
+	value, size := binary.Uvarint(decoder.data)
+	// every item counted by a length takes up at least one byte, so a
+	// length larger than what is left can never be valid
+	if size <= 0 || value > uint64(len(decoder.data)-size) {
+		decoder.err = errHeadTruncated
+		return 0
+	}
+	decoder.data = decoder.data[size:]
+	return int(value)
+}
+
+func (decoder *headDecoder) int() int {
+	if decoder.err != nil {
+		return 0
+	}
+	value, size := binary.Varint(decoder.data)
+	if size <= 0 {
+		decoder.err = errHeadTruncated
+		return 0
+	}
+	decoder.data = decoder.data[size:]
+	return int(value)
+}
+
+func (decoder *headDecoder) string() (value string) {
+	length := decoder.length()
+	if decoder.err != nil {
+		return ""
+	}
+	value = string(decoder.data[:length])
+	decoder.data = decoder.data[length:]
+	return value
+}
+
+func (decoder *headDecoder) stringMap() (values map[string][]string) {
+	count := decoder.length()
+	values = make(map[string][]string, count)
+	for index := 0; index < count && decoder.err == nil; index++ {
+		key := decoder.string()
+		list := make([]string, decoder.length())
+		for item := range list {
+			list[item] = decoder.string()
+		}
+		values[key] = append(values[key], list...)
+	}
+	return values
+}
@@ -0,0 +1,239 @@
+package cells
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hlhv/protocol"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/* benchReqHead is a request head like one a browser would send.
+ */
+var benchReqHead = protocol.FrameHTTPReqHead{
+	RemoteAddrReal: "203.0.113.7:51324",
+	RemoteAddr:     "203.0.113.7:51324",
+	Method:         "GET",
+	Scheme:         "https",
+	Host:           "www.example.com",
+	Port:           443,
+	Path:           "/articles/2021/07/some-long-article-title",
+	Query: map[string][]string{
+		"utm_source": {"newsletter"},
+		"page":       {"2"},
+	},
+	Proto:      "HTTP/2.0",
+	ProtoMajor: 2,
+	ProtoMinor: 0,
+	Headers: map[string][]string{
+		"accept": {"text/html,application/xhtml+xml," +
+			"application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"},
+		"accept-encoding": {"gzip, deflate, br"},
+		"accept-language": {"en-US,en;q=0.5"},
+		"cache-control":   {"no-cache"},
+		"referer":         {"https://www.example.com/articles/"},
+		"user-agent": {"Mozilla/5.0 (X11; Linux x86_64; rv:91.0) " +
+			"Gecko/20100101 Firefox/91.0"},
+		"cookie": {"session=6f1c2d3e4b5a69788796a5b4c3d2e1f0; " +
+			"theme=dark"},
+	},
+	Cookies: map[string][]string{
+		"session": {"6f1c2d3e4b5a69788796a5b4c3d2e1f0"},
+		"theme":   {"dark"},
+	},
+}
+
+func benchmarkHeads(bench *testing.B, features []string) {
+	cell := &Cell{features: make(map[string]bool)}
+	for _, feature := range features {
+		cell.features[feature] = true
+	}
+
+	// the queen only ever decodes response heads, so encode one the
+	// way a cell would to have something to decode
+	var resData []byte
+	if cell.HasFeature(FeatureBinaryHeads) {
+		resData = encodeResHead(&benchResHead)
+	} else {
+		frameData, err := protocol.MarshalFrame(&benchResHead)
+		if err != nil {
+			bench.Fatal(err)
+		}
+		resData = frameData[1:]
+	}
+
+	bench.ReportAllocs()
+	bench.ResetTimer()
+	for index := 0; index < bench.N; index++ {
+		_, err := cell.marshalReqHead(&benchReqHead)
+		if err != nil {
+			bench.Fatal(err)
+		}
+		frame := protocol.FrameHTTPResHead{}
+		err = cell.unmarshalResHead(resData, &frame)
+		if err != nil {
+			bench.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHeadsJSON(bench *testing.B) {
+	benchmarkHeads(bench, nil)
+}
+
+func BenchmarkHeadsBinary(bench *testing.B) {
+	benchmarkHeads(bench, []string{FeatureBinaryHeads})
+}
+
+/* benchResHead is a response head like one a cell would send.
+ */
+var benchResHead = protocol.FrameHTTPResHead{
+	StatusCode: 200,
+	Headers: map[string][]string{
+		"content-type":   {"text/html; charset=utf-8"},
+		"content-length": {"48213"},
+		"cache-control":  {"max-age=300"},
+		"set-cookie":     {"a=1; Path=/", "b=2; Path=/"},
+	},
+}
+
+/* encodeResHead encodes a response head in binary, the way a cell would.
+ */
+func encodeResHead(frame *protocol.FrameHTTPResHead) (data []byte) {
+	data = binary.AppendVarint(nil, int64(frame.StatusCode))
+	return appendHeadMap(data, frame.Headers)
+}
+
+/* decodeResHead decodes a binary response head, and turns a panic into an
+ * error so that every case is reported.
+ */
+func decodeResHead(data []byte) (frame protocol.FrameHTTPResHead, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panicked: %v", recovered)
+			frame = protocol.FrameHTTPResHead{}
+		}
+	}()
+	cell := &Cell{features: map[string]bool{FeatureBinaryHeads: true}}
+	err = cell.unmarshalResHead(data, &frame)
+	return frame, err
+}
+
+func TestResHeadRoundTrip(test *testing.T) {
+	cases := []protocol.FrameHTTPResHead{
+		benchResHead,
+		{StatusCode: 404, Headers: map[string][]string{}},
+		{StatusCode: -1, Headers: map[string][]string{"": {""}}},
+	}
+
+	for _, want := range cases {
+		got, err := decodeResHead(encodeResHead(&want))
+		if err != nil {
+			test.Errorf("%d: %v", want.StatusCode, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			test.Errorf(
+				"%d: decoded to %#v, expected %#v",
+				want.StatusCode, got, want)
+		}
+	}
+}
+
+func TestReqHeadRoundTrip(test *testing.T) {
+	cell := &Cell{features: map[string]bool{FeatureBinaryHeads: true}}
+	data, err := cell.marshalReqHead(&benchReqHead)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if protocol.FrameKind(data[0]) != protocol.FrameKindHTTPReqHead {
+		test.Fatal("request head has the wrong kind", data[0])
+	}
+
+	// decode the head the way a cell would
+	decoder := headDecoder{data: data[1:]}
+	got := protocol.FrameHTTPReqHead{
+		RemoteAddrReal: decoder.string(),
+		RemoteAddr:     decoder.string(),
+		Method:         decoder.string(),
+		Scheme:         decoder.string(),
+		Host:           decoder.string(),
+		Port:           decoder.int(),
+		Path:           decoder.string(),
+		Fragment:       decoder.string(),
+		Query:          decoder.stringMap(),
+		Proto:          decoder.string(),
+		ProtoMajor:     decoder.int(),
+		ProtoMinor:     decoder.int(),
+		Headers:        decoder.stringMap(),
+		Cookies:        decoder.stringMap(),
+	}
+	if decoder.err != nil {
+		test.Fatal(decoder.err)
+	}
+	if len(decoder.data) > 0 {
+		test.Fatal("request head has", len(decoder.data), "extra bytes")
+	}
+	if !reflect.DeepEqual(got, benchReqHead) {
+		test.Fatalf(
+			"decoded to %#v, expected %#v", got, benchReqHead)
+	}
+}
+
+func TestResHeadTruncated(test *testing.T) {
+	data := encodeResHead(&benchResHead)
+	for length := 0; length < len(data); length++ {
+		_, err := decodeResHead(data[:length])
+		if err == nil {
+			test.Errorf("head cut to %d bytes decoded", length)
+		}
+	}
+}
+
+func TestResHeadMalformed(test *testing.T) {
+	status := binary.AppendVarint(nil, 200)
+	huge := binary.AppendUvarint(nil, 1<<62)
+	tooLong := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0x01,
+	}
+	join := func(parts ...[]byte) (data []byte) {
+		for _, part := range parts {
+			data = append(data, part...)
+		}
+		return data
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"status overflows", tooLong},
+		{"key count overflows", join(status, tooLong)},
+		{"huge key count", join(status, huge)},
+		{"key count past the end", join(status, []byte{3, 0, 0})},
+		{"huge key length", join(status, []byte{1}, huge)},
+		{"key length past the end", join(status, []byte{1, 5, 'a'})},
+		{"huge value count", join(status, []byte{1, 1, 'a'}, huge)},
+		{"huge value length",
+			join(status, []byte{1, 1, 'a', 1}, huge)},
+		{"value length past the end",
+			join(status, []byte{1, 1, 'a', 1, 4, 'b', 'c'})},
+		{"trailing byte",
+			append(encodeResHead(&benchResHead), 0)},
+		{"trailing head",
+			join(encodeResHead(&benchResHead),
+				encodeResHead(&benchResHead))},
+	}
+
+	for _, testCase := range cases {
+		_, err := decodeResHead(testCase.data)
+		if err == nil {
+			test.Errorf("%s: malformed head decoded", testCase.name)
+		} else if strings.HasPrefix(err.Error(), "panicked") {
+			test.Errorf("%s: %v", testCase.name, err)
+		}
+	}
+}
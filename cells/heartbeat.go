@@ -0,0 +1,150 @@
+package cells
+
+import (
+	"encoding/json"
+	"github.com/hlhv/hlhv-queen/conf"
+	"github.com/hlhv/protocol"
+	"github.com/hlhv/scribe"
+	"sync"
+	"time"
+)
+
+/* heartbeat keeps track of pings sent to a cell on its leash.
+ */
+type heartbeat struct {
+	id       uint64
+	sent     time.Time
+	answered bool
+	missed   int
+	rtt      time.Duration
+	mutex    sync.Mutex
+}
+
+/* Heartbeat is supposed to be run in a separate goroutine. If the cell
+ * negotiated the heartbeat feature, it periodically pings the cell, and kicks
+ * it if it misses too many pings in a row. A half-open leash would otherwise go
+ * unnoticed, and leave the cell mounted while nothing answers its requests.
+ */
+func (cell *Cell) Heartbeat() {
+	if !cell.HasFeature(FeatureHeartbeat) {
+		return
+	}
+
+	for {
+		// the frequency is looked up every time, so that it can be
+		// changed by reloading the config file
+		freq := conf.GetHeartbeatFreq()
+		enabled := freq > 0
+		if !enabled {
+			freq = 1
+		}
+
+		timer := time.NewTimer(time.Duration(freq) * time.Second)
+		select {
+		case <-timer.C:
+		case <-cell.done:
+			timer.Stop()
+			return
+		}
+
+		if !enabled {
+			continue
+		}
+		interval := time.Duration(freq) * time.Second
+
+		cell.heartbeat.mutex.Lock()
+		if !cell.heartbeat.answered {
+			cell.heartbeat.missed++
+		}
+		missed := cell.heartbeat.missed
+		cell.heartbeat.mutex.Unlock()
+
+		if missed >= conf.GetHeartbeatMisses() {
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"cell", cell.uuid, "missed", missed,
+				"pings, kicking cell")
+			cell.leash.Close()
+			return
+		}
+
+		// the signal routine may be stuck writing to a leash that
+		// nothing is reading from anymore. then, the ping cannot even
+		// be sent, and it counts as missed.
+		timer = time.NewTimer(interval)
+		select {
+		case cell.sigQueue <- SigPing:
+		case <-timer.C:
+			cell.heartbeat.mutex.Lock()
+			cell.heartbeat.missed++
+			cell.heartbeat.mutex.Unlock()
+		case <-cell.done:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+/* ping sends a new ping to the cell. It must only be called from the signal
+ * routine, as that is the only one that writes to the leash. The write must
+ * finish before the next ping is due, and if it doesn't, the ping is left
+ * unanswered, so it counts as missed.
+ */
+func (cell *Cell) ping() {
+	cell.heartbeat.mutex.Lock()
+	cell.heartbeat.id++
+	cell.heartbeat.sent = time.Now()
+	cell.heartbeat.answered = false
+	id := cell.heartbeat.id
+	cell.heartbeat.mutex.Unlock()
+
+	freq := conf.GetHeartbeatFreq()
+	if freq <= 0 {
+		freq = 1
+	}
+	cell.leash.SetWriteDeadline(
+		time.Now().Add(time.Duration(freq) * time.Second))
+	_, err := protocol.WriteMarshalFrame(cell.Writer, &framePing{Id: id})
+	cell.leash.SetWriteDeadline(time.Time{})
+	if err != nil {
+		scribe.PrintError(
+			scribe.LogLevelError,
+			"could not ping cell:", err)
+	}
+}
+
+/* handlePong records the answer to a ping. Answers to pings other than the
+ * latest one are ignored, as they have already been counted as missed.
+ */
+func (cell *Cell) handlePong(data []byte) (err error) {
+	frame := framePong{}
+	err = json.Unmarshal(data, &frame)
+	if err != nil {
+		return err
+	}
+
+	cell.heartbeat.mutex.Lock()
+	defer cell.heartbeat.mutex.Unlock()
+
+	if frame.Id != cell.heartbeat.id || cell.heartbeat.answered {
+		return nil
+	}
+
+	cell.heartbeat.answered = true
+	cell.heartbeat.missed = 0
+	cell.heartbeat.rtt = time.Since(cell.heartbeat.sent)
+	scribe.PrintInfo(
+		scribe.LogLevelDebug,
+		"cell", cell.uuid, "round trip time", cell.heartbeat.rtt)
+	return nil
+}
+
+/* Rtt returns the round trip time of the last ping that the cell answered. It
+ * is zero if the cell has not answered any pings.
+ */
+func (cell *Cell) Rtt() time.Duration {
+	cell.heartbeat.mutex.Lock()
+	defer cell.heartbeat.mutex.Unlock()
+	return cell.heartbeat.rtt
+}
@@ -0,0 +1,58 @@
+package cells
+
+import (
+	"github.com/hlhv/fsock"
+	"github.com/hlhv/hlhv-queen/conf"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+/* TestHeartbeatStuckLeash checks that a cell is kicked when nothing reads from
+ * its leash anymore, even though pings can't be written to it.
+ */
+func TestHeartbeatStuckLeash(test *testing.T) {
+	confPath := test.TempDir() + "/hlhv.conf"
+	err := os.WriteFile(
+		confPath,
+		[]byte("heartbeatFreq 1\nheartbeatMisses 2\n"),
+		0600)
+	if err != nil {
+		test.Fatal(err)
+	}
+	err = conf.Load(confPath)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// nothing ever reads from the other end, so every write blocks
+	leash, other := net.Pipe()
+	defer other.Close()
+
+	cell := NewCell(
+		leash,
+		fsock.NewReader(leash),
+		fsock.NewWriter(leash),
+		"uuid", "", "", "",
+		[]string{FeatureHeartbeat},
+		nil)
+	go cell.ListenSig()
+
+	kicked := make(chan struct{})
+	go func() {
+		defer close(kicked)
+		cell.Heartbeat()
+	}()
+
+	select {
+	case <-kicked:
+	case <-time.After(10 * time.Second):
+		test.Fatal("cell with a stuck leash was never kicked")
+	}
+
+	_, err = leash.Write([]byte{0})
+	if err == nil {
+		test.Fatal("leash was not closed")
+	}
+}
@@ -0,0 +1,468 @@
+package cells
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/hlhv/hlhv-queen/conf"
+	"github.com/hlhv/protocol"
+	"github.com/hlhv/scribe"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/* muxHeaderSize is the size of the stream id that comes before the kind of
+ * every frame on a multiplexed band.
+ */
+const muxHeaderSize = 4
+
+var errStreamReset = errors.New("stream was reset by the cell")
+
+var errWriteInterrupted = errors.New("request was cancelled while writing")
+
+// errNoCredit is only used inside of reserve, and never returned
+var errNoCredit = errors.New("no credit")
+
+/* muxBand carries many requests over a single band connection at once. Every
+ * frame on it starts with the id of the stream it belongs to, and each request
+ * gets a stream of its own. The queen chooses the stream ids.
+ */
+type muxBand struct {
+	band    *Band
+	conn    *connTransport
+	streams map[uint32]*muxStream
+	nextId  uint32
+	window  int
+	mutex   sync.Mutex
+}
+
+/* muxStream is a transport for a single request on a multiplexed band. Frames
+ * that carry body or tunnel data are flow controlled separately for each
+ * stream, so that a slow request can never hold up the others: each side may
+ * only send as many bytes of data as the other has given it credit for, and
+ * gives credit back as it consumes what it was sent.
+ */
+type muxStream struct {
+	id  uint32
+	mux *muxBand
+
+	queue    []muxFrame
+	err      error
+	deadline time.Time
+
+	// readable and writable are poked whenever something changes that a
+	// reader or a writer might be waiting for. stopped is closed once
+	// nothing more may be written, because the stream has failed, been
+	// closed, or had its writes interrupted.
+	readable    chan struct{}
+	writable    chan struct{}
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	interrupted bool
+
+	// sendCredit is how much data may be sent to the cell, and consumed is
+	// how much data has been read since credit was last given back
+	sendCredit int
+	consumed   int
+	finished   bool
+
+	mutex sync.Mutex
+}
+
+type muxFrame struct {
+	kind protocol.FrameKind
+	data []byte
+}
+
+/* newMuxBand makes a band multiplexed, and starts reading frames from it.
+ */
+func newMuxBand(band *Band, window int) (mux *muxBand) {
+	mux = &muxBand{
+		band:    band,
+		conn:    band.transport.(*connTransport),
+		streams: make(map[uint32]*muxStream),
+		window:  window,
+	}
+	band.mux = mux
+	go mux.demux()
+	return mux
+}
+
+/* demux reads frames from the band, and hands each one to the stream it
+ * belongs to. It never waits on a stream, so one request that isn't being read
+ * cannot block the others. When the band closes, every stream on it fails.
+ */
+func (mux *muxBand) demux() {
+	var err error
+	for {
+		var frame []byte
+		frame, err = mux.conn.reader.Read()
+		if err != nil {
+			break
+		}
+
+		if len(frame) < muxHeaderSize+1 {
+			err = errors.New("multiplexed band sent a frame too short")
+			break
+		}
+
+		id := binary.BigEndian.Uint32(frame)
+		kind := protocol.FrameKind(frame[muxHeaderSize])
+		data := frame[muxHeaderSize+1:]
+
+		mux.mutex.Lock()
+		stream := mux.streams[id]
+		mux.mutex.Unlock()
+
+		// frames for streams that have already been closed are
+		// dropped
+		if stream == nil {
+			continue
+		}
+
+		switch kind {
+		case frameKindWindow:
+			frame := frameWindow{}
+			err = json.Unmarshal(data, &frame)
+			if err != nil {
+				break
+			}
+			stream.addCredit(frame.Bytes)
+		case frameKindStreamReset:
+			stream.fail(errStreamReset)
+		default:
+			stream.push(kind, data)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		scribe.PrintError(
+			scribe.LogLevelError,
+			"multiplexed band closed:", err)
+	}
+	mux.band.Close()
+
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	for _, stream := range mux.streams {
+		stream.fail(io.EOF)
+	}
+}
+
+/* open starts a new stream on the band, and returns a band that carries it. It
+ * returns nil if the band is closed, or already has as many streams as it is
+ * allowed.
+ */
+func (mux *muxBand) open() (stream *Band) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+
+	if !mux.band.isOpen() || len(mux.streams) >= conf.GetMuxMaxStreams() {
+		return nil
+	}
+
+	// never hand out zero, and skip over ids that are still in use if the
+	// counter ever wraps around
+	for {
+		mux.nextId++
+		_, exists := mux.streams[mux.nextId]
+		if mux.nextId != 0 && !exists {
+			break
+		}
+	}
+
+	transport := &muxStream{
+		id:         mux.nextId,
+		mux:        mux,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+		sendCredit: mux.window,
+	}
+	mux.streams[transport.id] = transport
+
+	return &Band{
+		transport: transport,
+		open:      1,
+		lock:      1,
+		parent:    mux.band,
+		lastUsed:  time.Now().UnixNano(),
+	}
+}
+
+/* available returns whether the band can take on another stream.
+ */
+func (mux *muxBand) available() bool {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	return len(mux.streams) < conf.GetMuxMaxStreams()
+}
+
+/* busy returns whether the band is carrying any streams.
+ */
+func (mux *muxBand) busy() bool {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	return len(mux.streams) > 0
+}
+
+/* write writes a frame for a stream onto the band.
+ */
+func (mux *muxBand) write(id uint32, frame []byte) (nn int, err error) {
+	muxFrame := make([]byte, muxHeaderSize+len(frame))
+	binary.BigEndian.PutUint32(muxFrame, id)
+	copy(muxFrame[muxHeaderSize:], frame)
+	return mux.band.WriteFrame(muxFrame)
+}
+
+/* remove forgets about a stream.
+ */
+func (mux *muxBand) remove(id uint32) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	delete(mux.streams, id)
+	mux.band.touch()
+}
+
+/* isFlowControlled returns whether a frame kind carries body or tunnel data.
+ */
+func isFlowControlled(kind protocol.FrameKind) bool {
+	return kind == protocol.FrameKindHTTPReqBody ||
+		kind == protocol.FrameKindHTTPResBody ||
+		kind == frameKindTunnelData
+}
+
+/* push adds a frame sent by the cell to the stream.
+ */
+func (stream *muxStream) push(kind protocol.FrameKind, data []byte) {
+	stream.mutex.Lock()
+	stream.queue = append(stream.queue, muxFrame{kind: kind, data: data})
+	stream.mutex.Unlock()
+	wake(stream.readable)
+}
+
+/* fail makes every read from the stream fail once its queue is empty.
+ */
+func (stream *muxStream) fail(err error) {
+	stream.mutex.Lock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.mutex.Unlock()
+	wake(stream.readable)
+	stream.stop()
+}
+
+/* stop wakes up every writer waiting for credit, for good.
+ */
+func (stream *muxStream) stop() {
+	stream.stopOnce.Do(func() { close(stream.stopped) })
+}
+
+/* addCredit allows more data to be sent to the cell.
+ */
+func (stream *muxStream) addCredit(bytes int) {
+	stream.mutex.Lock()
+	stream.sendCredit += bytes
+	stream.mutex.Unlock()
+	wake(stream.writable)
+}
+
+/* wake wakes up whatever is waiting on a channel, without ever blocking.
+ */
+func wake(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
+
+/* waitReadable waits for something to be readable from the stream, or for its
+ * read deadline to pass. It returns an error if the deadline has passed.
+ */
+func (stream *muxStream) waitReadable(deadline time.Time) (err error) {
+	if deadline.IsZero() {
+		<-stream.readable
+		return nil
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return errMuxTimeout{}
+	}
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-stream.readable:
+		return nil
+	case <-timer.C:
+		return errMuxTimeout{}
+	}
+}
+
+func (stream *muxStream) readFrame() (
+	kind protocol.FrameKind,
+	data []byte,
+	err error,
+) {
+	for {
+		stream.mutex.Lock()
+		if len(stream.queue) > 0 {
+			frame := stream.queue[0]
+			stream.queue = stream.queue[1:]
+
+			if frame.kind == protocol.FrameKindHTTPResEnd ||
+				frame.kind == frameKindTunnelClose {
+				stream.finished = true
+			}
+
+			// give credit back once half of the window has been
+			// used up, rather than for every single frame
+			credit := 0
+			if isFlowControlled(frame.kind) {
+				stream.consumed += len(frame.data)
+				if stream.consumed >= stream.mux.window/2 {
+					credit = stream.consumed
+					stream.consumed = 0
+				}
+			}
+			stream.mutex.Unlock()
+
+			if credit > 0 {
+				err = stream.writeControl(&frameWindow{Bytes: credit})
+				if err != nil {
+					return 0, nil, err
+				}
+			}
+			return frame.kind, frame.data, nil
+		}
+
+		err = stream.err
+		deadline := stream.deadline
+		stream.mutex.Unlock()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		err = stream.waitReadable(deadline)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+func (stream *muxStream) writeFrame(frame []byte) (nn int, err error) {
+	return stream.mux.write(stream.id, frame)
+}
+
+/* reserve waits until the cell has given credit for more data, and then uses
+ * up as much of it as the frame carries. The last frame sent may go over the
+ * credit that is left. Frames that are not flow controlled never wait. The wait
+ * ends early if the stream stops, or if the cell gives no credit within the
+ * write timeout.
+ */
+func (stream *muxStream) reserve(frame []byte) (err error) {
+	if len(frame) == 0 || !isFlowControlled(protocol.FrameKind(frame[0])) {
+		return nil
+	}
+	bytes := len(frame) - 1
+
+	var timeout <-chan time.Time
+	for {
+		stream.mutex.Lock()
+		switch {
+		case stream.interrupted:
+			err = errWriteInterrupted
+		case stream.err != nil:
+			err = stream.err
+		case stream.sendCredit > 0:
+			stream.sendCredit -= bytes
+		default:
+			err = errNoCredit
+		}
+		stream.mutex.Unlock()
+		if err != errNoCredit {
+			return err
+		}
+		err = nil
+
+		if timeout == nil {
+			timer := time.NewTimer(
+				time.Duration(conf.GetTimeoutWrite()) *
+					time.Second)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-stream.writable:
+		case <-stream.stopped:
+		case <-timeout:
+			return errMuxTimeout{}
+		}
+	}
+}
+
+/* interrupt makes every write waiting for credit give up, along with every
+ * flow controlled write after it.
+ */
+func (stream *muxStream) interrupt() {
+	stream.mutex.Lock()
+	stream.interrupted = true
+	stream.mutex.Unlock()
+	stream.stop()
+}
+
+/* writeControl marshals and writes a frame that is not flow controlled.
+ */
+func (stream *muxStream) writeControl(frame protocol.Frame) (err error) {
+	frameData, err := protocol.MarshalFrame(frame)
+	if err != nil {
+		return err
+	}
+	_, err = stream.mux.write(stream.id, frameData)
+	return err
+}
+
+func (stream *muxStream) setReadDeadline(deadline time.Time) error {
+	stream.mutex.Lock()
+	stream.deadline = deadline
+	stream.mutex.Unlock()
+	wake(stream.readable)
+	return nil
+}
+
+/* close ends the stream. If the response was not finished, the cell is told to
+ * reset the stream, so that it stops working on it.
+ */
+func (stream *muxStream) close() error {
+	stream.mutex.Lock()
+	finished := stream.finished
+	failed := stream.err != nil
+	stream.finished = true
+	stream.err = io.EOF
+	stream.mutex.Unlock()
+	wake(stream.readable)
+	stream.stop()
+
+	stream.mux.remove(stream.id)
+	if !finished && !failed {
+		return stream.writeControl(&frameStreamReset{})
+	}
+	return nil
+}
+
+/* errMuxTimeout is returned when a stream's read deadline passes. Like the
+ * errors returned by connections, it counts as a timeout.
+ */
+type errMuxTimeout struct{}
+
+func (errMuxTimeout) Error() string   { return "stream read timed out" }
+func (errMuxTimeout) Timeout() bool   { return true }
+func (errMuxTimeout) Temporary() bool { return true }
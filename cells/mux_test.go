@@ -0,0 +1,110 @@
+package cells
+
+import (
+	"github.com/hlhv/fsock"
+	"github.com/hlhv/hlhv-queen/conf"
+	"github.com/hlhv/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+/* newTestMux opens a multiplexed band over an in-memory connection, with a
+ * cell on the other end that reads every frame and never gives any credit.
+ */
+func newTestMux(test *testing.T, window int) (mux *muxBand) {
+	conf.Load(test.TempDir() + "/none.conf")
+
+	queenConn, cellConn := net.Pipe()
+	test.Cleanup(func() {
+		queenConn.Close()
+		cellConn.Close()
+	})
+	go io.Copy(io.Discard, cellConn)
+
+	band := NewBand(
+		queenConn,
+		fsock.NewReader(queenConn),
+		fsock.NewWriter(queenConn))
+	return newMuxBand(band, window)
+}
+
+func TestCancelDuringCreditWait(test *testing.T) {
+	mux := newTestMux(test, 10)
+	stream := mux.open()
+	if stream == nil {
+		test.Fatal("could not open a stream")
+	}
+
+	body := append(
+		[]byte{byte(protocol.FrameKindHTTPReqBody)},
+		make([]byte, 20)...)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := stream.WriteFrame(body)
+		if err != nil {
+			written <- err
+			return
+		}
+		// the window is used up now, so this waits for credit
+		_, err = stream.WriteFrame(body)
+		written <- err
+	}()
+
+	// give the writer time to start waiting
+	time.Sleep(100 * time.Millisecond)
+
+	cancelled := make(chan struct{})
+	go func() {
+		defer close(cancelled)
+		stream.Cancel(true)
+	}()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		test.Fatal("Cancel blocked behind a write waiting for credit")
+	}
+
+	select {
+	case err := <-written:
+		if err != errWriteInterrupted {
+			test.Fatal("write waiting for credit returned", err)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("write waiting for credit was not woken by Cancel")
+	}
+}
+
+func TestCloseDuringCreditWait(test *testing.T) {
+	mux := newTestMux(test, 10)
+	stream := mux.open()
+	if stream == nil {
+		test.Fatal("could not open a stream")
+	}
+
+	body := append(
+		[]byte{byte(protocol.FrameKindHTTPReqBody)},
+		make([]byte, 20)...)
+
+	written := make(chan error, 1)
+	go func() {
+		stream.WriteFrame(body)
+		_, err := stream.WriteFrame(body)
+		written <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	mux.band.Close()
+
+	select {
+	case err := <-written:
+		if err == nil {
+			test.Fatal("write waiting for credit succeeded after close")
+		}
+	case <-time.After(time.Second):
+		test.Fatal("write waiting for credit was not woken by close")
+	}
+}
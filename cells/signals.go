@@ -10,6 +10,8 @@ type Sig int
 const (
 	SigCleaning Sig = iota
 	SigNeedBand
+	SigPing
+	SigMountReject
 )
 
 func (cell *Cell) ListenSig() {
@@ -28,17 +30,35 @@ func (cell *Cell) handleSig(sig Sig) (run bool) {
 	case SigCleaning:
 		return false
 	case SigNeedBand:
+		// several signals may have been sent for the same bands, so
+		// only the first one that gets here asks for them
+		count := cell.takeNeeded()
+		if count == 0 {
+			break
+		}
 		scribe.PrintProgress(
 			scribe.LogLevelDebug,
-			"requesting new band")
+			"requesting", count, "new bands")
 		protocol.WriteMarshalFrame(writer, &protocol.FrameNeedBand{
-			Count: 1,
+			Count: count,
 		})
+	case SigPing:
+		cell.ping()
+	case SigMountReject:
+		for _, frame := range cell.takeRejected() {
+			protocol.WriteMarshalFrame(writer, frame)
+		}
 	}
 
 	return true
 }
 
+/* SendSig queues a signal to be handled by the cell's signal routine. Once the
+ * cell has been cleaned up, signals are dropped.
+ */
 func (cell *Cell) SendSig(sig Sig) {
-	cell.sigQueue <- sig
+	select {
+	case cell.sigQueue <- sig:
+	case <-cell.done:
+	}
 }
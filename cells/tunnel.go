@@ -0,0 +1,235 @@
+package cells
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/hlhv/hlhv-queen/conf"
+	"github.com/hlhv/hlhv-queen/srvhttps"
+	"github.com/hlhv/protocol"
+	"github.com/hlhv/scribe"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* tunnel carries the raw bytes of an upgraded connection, such as a websocket,
+ * between the client and a band. The band is reserved for the tunnel until it
+ * is closed, after which the band is closed as well.
+ */
+type tunnel struct {
+	client   net.Conn
+	reader   *bufio.Reader
+	band     *Band
+	lastUsed int64
+	once     sync.Once
+}
+
+/* isUpgrade returns whether the client asked to switch to another protocol.
+ */
+func isUpgrade(req *http.Request) bool {
+	if req.ProtoMajor != 1 || req.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* openTunnel takes over the client connection after the cell agreed to switch
+ * protocols, sends the client the cell's response head, and then carries data
+ * both ways until either side closes the connection, or it has been idle for
+ * longer than the tunnel idle timeout.
+ */
+func openTunnel(
+	res http.ResponseWriter,
+	req *http.Request,
+	band *Band,
+	resHead *protocol.FrameHTTPResHead,
+) {
+	client, clientBuffer, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		band.Close()
+		err = errors.New(fmt.Sprint("cannot take over connection: ", err))
+		scribe.PrintError(scribe.LogLevelError, err)
+		srvhttps.WriteBadGateway(res, req, err)
+		return
+	}
+
+	// the server's deadlines no longer apply
+	client.SetDeadline(time.Time{})
+
+	header := make(http.Header)
+	for key, values := range resHead.Headers {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+
+	fmt.Fprintf(clientBuffer, "HTTP/1.1 %d %s\r\n",
+		resHead.StatusCode, http.StatusText(resHead.StatusCode))
+	header.Write(clientBuffer)
+	clientBuffer.WriteString("\r\n")
+	err = clientBuffer.Flush()
+	if err != nil {
+		client.Close()
+		band.Close()
+		scribe.PrintError(scribe.LogLevelError, "cannot open tunnel:", err)
+		return
+	}
+
+	scribe.PrintProgress(scribe.LogLevelDebug, "opened tunnel")
+	tunnel := &tunnel{
+		client: client,
+		reader: clientBuffer.Reader,
+		band:   band,
+	}
+	tunnel.touch()
+
+	done := make(chan struct{})
+	go func() {
+		tunnel.fromClient()
+		close(done)
+	}()
+	tunnel.fromCell()
+	<-done
+
+	scribe.PrintDone(scribe.LogLevelDebug, "closed tunnel")
+}
+
+/* fromClient sends data from the client to the cell, until the client closes
+ * the connection.
+ */
+func (tunnel *tunnel) fromClient() {
+	buffer := make([]byte, conf.GetBodyChunkSize())
+	for {
+		tunnel.client.SetReadDeadline(tunnel.deadline())
+		bytesRead, err := tunnel.reader.Read(buffer)
+		if bytesRead > 0 {
+			tunnel.touch()
+			_, writeErr := tunnel.band.WriteFrame(append(
+				[]byte{byte(frameKindTunnelData)},
+				buffer[:bytesRead]...,
+			))
+			if writeErr != nil {
+				tunnel.close(false)
+				return
+			}
+		}
+
+		if tunnel.idle(err) {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				scribe.PrintInfo(
+					scribe.LogLevelDebug,
+					"tunnel client closed:", err)
+			}
+			tunnel.close(true)
+			return
+		}
+	}
+}
+
+/* fromCell sends data from the cell to the client, until the cell closes the
+ * tunnel.
+ */
+func (tunnel *tunnel) fromCell() {
+	for {
+		tunnel.band.transport.setReadDeadline(tunnel.deadline())
+
+		// the band's own read function would close it on a timeout
+		kind, data, err := tunnel.band.transport.readFrame()
+		if tunnel.idle(err) {
+			continue
+		}
+		if err != nil {
+			// if the band only timed out, it can still be used to
+			// tell the cell that the tunnel is closing
+			var netErr net.Error
+			tunnel.close(errors.As(err, &netErr) && netErr.Timeout())
+			return
+		}
+
+		switch kind {
+		case frameKindTunnelData:
+			tunnel.touch()
+			_, err = tunnel.client.Write(data)
+			if err != nil {
+				tunnel.close(true)
+				return
+			}
+		case frameKindTunnelClose:
+			tunnel.close(false)
+			return
+		default:
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"band sent unknown code", kind,
+				"in tunnel, closing")
+			tunnel.close(false)
+			return
+		}
+	}
+}
+
+/* idle returns true if err is a timeout, but the tunnel has been used recently
+ * enough in the other direction that it should be kept open. If the tunnel has
+ * been idle for too long, it returns false, so that err is treated like any
+ * other error.
+ */
+func (tunnel *tunnel) idle(err error) bool {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+
+	if time.Now().Before(tunnel.deadline()) {
+		return true
+	}
+
+	scribe.PrintInfo(scribe.LogLevelDebug, "tunnel idle for too long")
+	return false
+}
+
+/* touch marks the tunnel as used.
+ */
+func (tunnel *tunnel) touch() {
+	atomic.StoreInt64(&tunnel.lastUsed, time.Now().UnixNano())
+}
+
+/* deadline returns when the tunnel will be closed if nothing is sent through
+ * it, or the zero time if it may stay idle forever.
+ */
+func (tunnel *tunnel) deadline() time.Time {
+	timeout := conf.GetTunnelIdleTimeout()
+	if timeout == 0 {
+		return time.Time{}
+	}
+	lastUsed := time.Unix(0, atomic.LoadInt64(&tunnel.lastUsed))
+	return lastUsed.Add(time.Duration(timeout) * time.Second)
+}
+
+/* close closes both ends of the tunnel. If tellCell is true, the cell is sent a
+ * close frame first.
+ */
+func (tunnel *tunnel) close(tellCell bool) {
+	tunnel.once.Do(func() {
+		if tellCell {
+			tunnel.band.WriteMarshalFrame(&frameTunnelClose{})
+		}
+		tunnel.client.Close()
+		tunnel.band.Close()
+	})
+}
@@ -0,0 +1,166 @@
+package conf
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/* Aliases are resolved in order of precedence: exact matches, then wildcard
+ * matches (longest first), then regular expressions in the order they were
+ * defined, and finally the fallback.
+ */
+
+type aliasKind int
+
+const (
+	aliasKindExact aliasKind = iota
+	aliasKindWildcard
+	aliasKindRegexp
+)
+
+/* aliasRule is a single alias, as written in the config file.
+ */
+type aliasRule struct {
+	pattern string
+	value   string
+	kind    aliasKind
+
+	// for wildcards, the part of the pattern after the *
+	suffix string
+	// for regular expressions, the compiled expression
+	expression *regexp.Regexp
+}
+
+/* aliasTable is a precompiled set of aliases, used to resolve hostnames.
+ */
+type aliasTable struct {
+	exact     map[string]string
+	wildcards []aliasRule // sorted from longest to shortest suffix
+	regexps   []aliasRule // in the order they were defined
+	fallback  string
+}
+
+/* newAliasRule parses an alias pattern. Patterns starting with ~ are regular
+ * expressions, patterns starting with *. are wildcards that match any
+ * subdomain, and all other patterns must match exactly.
+ */
+func newAliasRule(pattern string, value string) (rule aliasRule, err error) {
+	rule = aliasRule{pattern: pattern, value: value}
+
+	switch {
+	case strings.HasPrefix(pattern, "~"):
+		rule.kind = aliasKindRegexp
+		rule.expression, err = regexp.Compile(pattern[1:])
+		if err != nil {
+			return rule, errors.New(
+				"malformed alias, invalid regular expression: " +
+					err.Error())
+		}
+
+	case strings.HasPrefix(pattern, "*."):
+		rule.kind = aliasKindWildcard
+		rule.suffix = strings.ToLower(pattern[1:])
+		if strings.Contains(rule.suffix, "*") {
+			return rule, errors.New(
+				"malformed alias, * is only allowed as the " +
+					"first label of a pattern")
+		}
+
+	default:
+		rule.kind = aliasKindExact
+		if strings.Contains(pattern, "*") {
+			return rule, errors.New(
+				"malformed alias, * is only allowed as the " +
+					"first label of a pattern")
+		}
+	}
+
+	return rule, nil
+}
+
+/* compileAliases builds an alias table out of a list of rules.
+ */
+func compileAliases(rules []aliasRule, fallback string) (table *aliasTable) {
+	table = &aliasTable{
+		exact:    make(map[string]string),
+		fallback: fallback,
+	}
+
+	for _, rule := range rules {
+		switch rule.kind {
+		case aliasKindExact:
+			table.exact[strings.ToLower(rule.pattern)] = rule.value
+		case aliasKindWildcard:
+			table.wildcards = append(table.wildcards, rule)
+		case aliasKindRegexp:
+			table.regexps = append(table.regexps, rule)
+		}
+	}
+
+	sort.SliceStable(table.wildcards, func(left, right int) bool {
+		return len(table.wildcards[left].suffix) >
+			len(table.wildcards[right].suffix)
+	})
+
+	return table
+}
+
+/* resolve finds the alias that applies to a hostname, and returns its value. If
+ * there is none, the hostname is returned as is. Every kind of alias is matched
+ * against the hostname in lower case.
+ */
+func (table *aliasTable) resolve(input string) (output string) {
+	lowerInput := strings.ToLower(input)
+
+	value, exists := table.exact[lowerInput]
+	if exists {
+		return value
+	}
+
+	for _, rule := range table.wildcards {
+		// the wildcard must stand for at least one character
+		if len(lowerInput) > len(rule.suffix) &&
+			strings.HasSuffix(lowerInput, rule.suffix) {
+			return rule.value
+		}
+	}
+
+	for _, rule := range table.regexps {
+		match := rule.expression.FindStringSubmatchIndex(lowerInput)
+		if match != nil {
+			return string(rule.expression.ExpandString(
+				nil, rule.value, lowerInput, match))
+		}
+	}
+
+	if table.fallback != "" {
+		return table.fallback
+	}
+
+	return input
+}
+
+/* setAlias adds an alias to the parser, replacing any existing alias with the
+ * same pattern. The alias is moved to the end of the list, so that regular
+ * expressions are tried in the order they were last defined.
+ */
+func (state *parser) setAlias(rule aliasRule) {
+	state.removeAlias(rule.pattern)
+	state.aliases = append(state.aliases, rule)
+}
+
+/* removeAlias removes the alias with the given pattern from the parser, if it
+ * exists.
+ */
+func (state *parser) removeAlias(pattern string) {
+	newLen := 0
+	for _, rule := range state.aliases {
+		if rule.pattern != pattern {
+			state.aliases[newLen] = rule
+			newLen++
+		}
+	}
+	state.aliases = state.aliases[:newLen]
+}
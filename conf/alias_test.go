@@ -0,0 +1,44 @@
+package conf
+
+import (
+	"testing"
+)
+
+func TestResolveAliases(test *testing.T) {
+	rules := []aliasRule{}
+	for _, alias := range [][2]string{
+		{"example.com", "@"},
+		{"*.example.com", "sub"},
+		{`~^(.+)\.dev\.example\.com$`, "$1"},
+		{`~^(.+)\.test\.org$`, "$1"},
+	} {
+		rule, err := newAliasRule(alias[0], alias[1])
+		if err != nil {
+			test.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	table := compileAliases(rules, "")
+
+	cases := []struct {
+		input  string
+		output string
+	}{
+		{"example.com", "@"},
+		{"EXAMPLE.com", "@"},
+		{"www.Example.com", "sub"},
+		{"api.dev.example.com", "sub"},
+		{"api.test.org", "api"},
+		{"API.Test.org", "api"},
+		{"Other.org", "Other.org"},
+	}
+
+	for _, testCase := range cases {
+		output := table.resolve(testCase.input)
+		if output != testCase.output {
+			test.Errorf(
+				"%s resolved to %q, expected %q",
+				testCase.input, output, testCase.output)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package conf
 
 import (
 	"bufio"
+	"errors"
 	"github.com/hlhv/scribe"
 	"io"
 	"os"
@@ -16,74 +17,240 @@ type databaseType struct {
 	certPath string
 	connKey  string
 
+	clientCert   string
+	clientCaPath string
+
 	portHlhv  int
 	portHttps int
 
 	gardenFreq int
 	maxBandAge int
+	minBands   int
+	maxBands   int
+
+	heartbeatFreq   int
+	heartbeatMisses int
+
+	bodyChunkSize     int
+	tunnelIdleTimeout int
+
+	muxMaxStreams int
+	muxWindow     int
+
+	balanceStrategy string
+
+	bandTimeout    int
+	bandQueueDepth int
+
+	handshakeWorkers   int
+	maxHandshakes      int
+	maxHandshakesPerIp int
 
 	timeout           int
 	timeoutReadHeader int
 	timeoutRead       int
 	timeoutWrite      int
 	timeoutIdle       int
+	timeoutDrain      int
 }
 
 var items struct {
 	database databaseType
+	patterns map[string]*patternItems
+	cellKeys map[string]string
+	sources  map[string]string
 	mutex    sync.RWMutex
+
+	// allowMounts lists the prefixes each cell identity may mount
+	allowMounts map[string][]string
 }
 
 var aliases struct {
+	rules []aliasRule
+	table *aliasTable
+	mutex sync.RWMutex
+}
+
+/* parser holds the state built up while reading a config file. Nothing in it
+ * is visible to the rest of the program until it is committed.
+ */
+type parser struct {
+	database databaseType
+	patterns map[string]*patternItems
+	cellKeys map[string]string
+	sources  map[string]string
 	fallback string
-	database map[string]string
-	mutex    sync.RWMutex
+	aliases  []aliasRule
+	errors   ParseErrors
+
+	allowMounts map[string][]string
+
+	// absolute paths of the files currently being read, outermost first
+	includeStack []string
 }
 
+/* Load reads the config file at confpath and makes it the active
+ * configuration. If the file cannot be read, the default configuration is used
+ * along with any environment and command line overrides, and the error is
+ * returned.
+ */
 func Load(confpath string) (err error) {
 	scribe.PrintProgress(scribe.LogLevelNormal, "reading config file")
 
-	items.mutex.RLock()
-	aliases.mutex.RLock()
-	defer aliases.mutex.RUnlock()
-	defer items.mutex.RUnlock()
-
-	// default aliases
-	aliases.database = map[string]string{
-		"localhost":        "@",
-		"127.0.0.1":        "@",
-		"::ffff:127.0.0.1": "@",
-		"::1":              "@",
+	state := newParser()
+	err = state.parse(confpath)
+	if _, invalid := err.(ParseErrors); err != nil && !invalid {
+		// the file could not be read, but overrides from the
+		// environment and command line still apply
+		state = newParser()
+		overrideErr := state.parseOverrides()
+		if overrideErr != nil {
+			return overrideErr
+		}
 	}
 
-	// default configuration items
-	items.database = databaseType{
-		keyPath:  "/var/hlhv/cert/key.pem",
-		certPath: "/var/hlhv/cert/cert.pem",
-		connKey:  "",
+	state.commit()
+	analyzeConfig()
+	return err
+}
 
-		portHlhv:  2001,
-		portHttps: 443,
+/* Check reads the config file at confpath without applying it, and returns
+ * every problem found in it.
+ */
+func Check(confpath string) (err error) {
+	return newParser().parse(confpath)
+}
 
-		gardenFreq: 120,
-		maxBandAge: 60,
+/* Reload re-reads the config file at confpath. If it can be read, it atomically
+ * replaces the active configuration and returns a list of human readable
+ * changes. If it cannot be read, the active configuration is left untouched.
+ */
+func Reload(confpath string) (changes []string, err error) {
+	scribe.PrintProgress(scribe.LogLevelNormal, "re-reading config file")
 
-		timeout:           1,
-		timeoutReadHeader: 5,
-		timeoutRead:       10,
-		timeoutWrite:      15,
-		timeoutIdle:       120,
+	state := newParser()
+	err = state.parse(confpath)
+	if err != nil {
+		return nil, err
 	}
 
+	changes = state.diff()
+	state.commit()
+	analyzeConfig()
+	return changes, nil
+}
+
+/* newParser returns a parser filled with the default configuration.
+ */
+func newParser() (state *parser) {
+	state = &parser{
+		// default configuration items
+		database: databaseType{
+			keyPath:  "/var/hlhv/cert/key.pem",
+			certPath: "/var/hlhv/cert/cert.pem",
+			connKey:  "",
+
+			clientCert:   ClientCertOff,
+			clientCaPath: "",
+
+			portHlhv:  2001,
+			portHttps: 443,
+
+			gardenFreq: 120,
+			maxBandAge: 60,
+			minBands:   1,
+			maxBands:   64,
+
+			heartbeatFreq:   10,
+			heartbeatMisses: 3,
+
+			bodyChunkSize:     32768,
+			tunnelIdleTimeout: 300,
+
+			muxMaxStreams: 100,
+			muxWindow:     262144,
+
+			balanceStrategy: BalanceRoundRobin,
+
+			bandTimeout:    5,
+			bandQueueDepth: 64,
+
+			handshakeWorkers:   32,
+			maxHandshakes:      256,
+			maxHandshakesPerIp: 64,
+
+			timeout:           1,
+			timeoutReadHeader: 5,
+			timeoutRead:       10,
+			timeoutWrite:      15,
+			timeoutIdle:       120,
+			timeoutDrain:      300,
+		},
+
+		// default aliases
+		aliases: []aliasRule{
+			{pattern: "localhost", value: "@"},
+			{pattern: "127.0.0.1", value: "@"},
+			{pattern: "::ffff:127.0.0.1", value: "@"},
+			{pattern: "::1", value: "@"},
+		},
+
+		patterns: make(map[string]*patternItems),
+		cellKeys: make(map[string]string),
+		sources:  make(map[string]string),
+
+		allowMounts: make(map[string][]string),
+	}
+
+	for _, entry := range state.database.entries() {
+		state.sources[entry.key] = "default"
+	}
+	return state
+}
+
+/* commit makes the parser's state the active configuration.
+ */
+func (state *parser) commit() {
+	items.mutex.Lock()
+	aliases.mutex.Lock()
+	defer aliases.mutex.Unlock()
+	defer items.mutex.Unlock()
+
+	items.database = state.database
+	items.patterns = state.patterns
+	items.cellKeys = state.cellKeys
+	items.allowMounts = state.allowMounts
+	items.sources = state.sources
+	aliases.rules = state.aliases
+	aliases.table = compileAliases(state.aliases, state.fallback)
+}
+
+/* parseFile reads a single config file into the parser. If the file cannot be
+ * read, that error is returned directly. Problems found in the file itself are
+ * recorded in the parser instead.
+ */
+func (state *parser) parseFile(confpath string) (err error) {
 	file, err := os.OpenFile(confpath, os.O_RDONLY, 0755)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	reader := bufio.NewReader(file)
 
+	state.includeStack = append(state.includeStack, confpath)
+	defer func() {
+		state.includeStack = state.includeStack[:len(state.includeStack)-1]
+	}()
+
 	var key string
 	var val string
-	var state int
+	var parseState int
+
+	line := 1
+	column := 0
+	var keyColumn int
+	var valColumn int
+
 	for {
 		ch, _, err := reader.ReadRune()
 		if err != nil {
@@ -92,25 +259,31 @@ func Load(confpath string) (err error) {
 			}
 			return err
 		}
+		column++
 
-		switch state {
+		switch parseState {
 		case 0:
 			// wait for key or comment
 			if ch == '#' {
-				state = 3
+				parseState = 3
 			} else if !unicode.IsSpace(ch) {
-				state = 1
+				parseState = 1
+				keyColumn = column
 				reader.UnreadRune()
+				column--
 			}
 			break
 
 		case 1:
 			// ignore whitespace until value (or EOL)
 			if ch == '\n' {
+				state.addError(
+					confpath, line, keyColumn,
+					"key "+key+" has no value")
 				key = ""
-				state = 0
+				parseState = 0
 			} else if unicode.IsSpace(ch) {
-				state = 2
+				parseState = 2
 			} else {
 				key += string(ch)
 			}
@@ -119,11 +292,17 @@ func Load(confpath string) (err error) {
 		case 2:
 			// get key until EOL
 			if ch == '\n' {
-				handleKeyVal(key, strings.TrimSpace(val))
+				state.handleLine(
+					confpath, line, keyColumn, valColumn,
+					key, val)
 				key = ""
 				val = ""
-				state = 0
+				valColumn = 0
+				parseState = 0
 			} else {
+				if valColumn == 0 && !unicode.IsSpace(ch) {
+					valColumn = column
+				}
 				val += string(ch)
 			}
 			break
@@ -131,31 +310,122 @@ func Load(confpath string) (err error) {
 		case 3:
 			// ignore comment until EOL
 			if ch == '\n' {
-				state = 0
+				parseState = 0
 			}
 			break
 		}
+
+		if ch == '\n' {
+			line++
+			column = 0
+		}
+	}
+
+	// the last line might not end in a newline
+	switch parseState {
+	case 1:
+		state.addError(
+			confpath, line, keyColumn,
+			"key "+key+" has no value")
+	case 2:
+		state.handleLine(confpath, line, keyColumn, valColumn, key, val)
 	}
 
-	file.Close()
-	analyzeConfig()
 	return nil
 }
 
+/* handleLine handles a single key/value line, and records an error describing
+ * what was wrong with it if it could not be handled.
+ */
+func (state *parser) handleLine(
+	confpath string,
+	line int,
+	keyColumn int,
+	valColumn int,
+	key string,
+	val string,
+) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		state.addError(
+			confpath, line, keyColumn,
+			"key "+key+" has no value")
+		return
+	}
+
+	var err error
+	if key == "include" {
+		err = state.include(confpath, val)
+	} else {
+		err = state.handleKeyVal(key, val)
+	}
+	if err == nil {
+		if _, isItem := state.sources[key]; isItem {
+			state.sources[key] = confpath + ":" + strconv.Itoa(line)
+		}
+		return
+	}
+
+	if _, unknown := err.(unknownKeyError); unknown {
+		state.addError(confpath, line, keyColumn, err.Error())
+	} else {
+		state.addError(confpath, line, valColumn, err.Error())
+	}
+}
+
+/* addError records a problem found while parsing.
+ */
+func (state *parser) addError(
+	file string,
+	line int,
+	column int,
+	message string,
+) {
+	state.errors = append(state.errors, &ParseError{
+		File:    file,
+		Line:    line,
+		Column:  column,
+		Message: message,
+	})
+}
+
 func analyzeConfig() {
-	if aliases.fallback != "" {
+	items.mutex.RLock()
+	aliases.mutex.RLock()
+	defer aliases.mutex.RUnlock()
+	defer items.mutex.RUnlock()
+
+	if aliases.table.fallback != "" {
 		scribe.PrintInfo(
 			scribe.LogLevelDebug,
-			"using alias (fallback) -> "+aliases.fallback)
+			"using alias (fallback) -> "+aliases.table.fallback)
 	}
 
-	for key, val := range aliases.database {
+	for _, rule := range aliases.rules {
 		scribe.PrintInfo(
 			scribe.LogLevelDebug,
-			"using alias "+key+" -> "+val)
+			"using alias "+rule.pattern+" -> "+rule.value)
 	}
 
-	if items.database.connKey == "" {
+	for _, entry := range items.database.entries() {
+		value := entry.value
+		if entry.key == "connKey" && value != "" {
+			value = "(hidden)"
+		}
+		scribe.PrintInfo(
+			scribe.LogLevelDebug,
+			"using "+entry.key+" "+value+
+				" from "+items.sources[entry.key])
+	}
+
+	for name := range items.cellKeys {
+		scribe.PrintInfo(
+			scribe.LogLevelDebug,
+			"using cellKey "+name+" (hidden)")
+	}
+
+	if items.database.connKey == "" && len(items.cellKeys) == 0 &&
+		items.database.clientCert != ClientCertRequired {
 		scribe.PrintWarning(
 			scribe.LogLevelError,
 			"CONNECTION KEY WAS NOT SET, SYSTEM IS VULNERABLE TO "+
@@ -164,77 +434,162 @@ func analyzeConfig() {
 	}
 }
 
-func handleKeyVal(key string, val string) {
-	valn, _ := strconv.Atoi(val)
-
+/* handleKeyVal sets a single configuration item, or runs a command.
+ */
+func (state *parser) handleKeyVal(key string, val string) (err error) {
 	switch key {
 	case "alias":
-		parseAlias(key, val)
+		return state.parseAlias(key, val)
 	case "unalias":
-		delete(aliases.database, val)
+		state.removeAlias(val)
+		return nil
+	case "balance":
+		return state.parseBalance(val)
+	case "weight":
+		return state.parseWeight(val)
+	case "pinVersion":
+		return state.parsePinVersion(val)
+	case "affinity":
+		return state.parseAffinity(val)
+	case "cellKey":
+		return state.parseCellKey(val)
+	case "allowMount":
+		return state.parseAllowMount(val)
 
 	case "keyPath":
-		items.database.keyPath = val
+		state.database.keyPath = val
 	case "certPath":
-		items.database.certPath = val
+		state.database.certPath = val
 	case "connKey":
-		items.database.connKey = val
+		state.database.connKey = val
+	case "clientCert":
+		return parseClientCert(val, &state.database.clientCert)
+	case "clientCaPath":
+		state.database.clientCaPath = val
 	case "portHlhv":
-		items.database.portHlhv = valn
+		return parsePort(val, &state.database.portHlhv)
 	case "portHttps":
-		items.database.portHttps = valn
+		return parsePort(val, &state.database.portHttps)
 	case "gardenFreq":
-		items.database.gardenFreq = valn
+		return parseInt(val, 1, &state.database.gardenFreq)
 	case "maxBandAge":
-		items.database.maxBandAge = valn
+		return parseInt(val, 0, &state.database.maxBandAge)
+	case "minBands":
+		return parseInt(val, 0, &state.database.minBands)
+	case "maxBands":
+		return parseInt(val, 1, &state.database.maxBands)
+	case "heartbeatFreq":
+		return parseInt(val, 0, &state.database.heartbeatFreq)
+	case "heartbeatMisses":
+		return parseInt(val, 1, &state.database.heartbeatMisses)
+	case "bodyChunkSize":
+		return parseInt(val, 1, &state.database.bodyChunkSize)
+	case "tunnelIdleTimeout":
+		return parseInt(val, 0, &state.database.tunnelIdleTimeout)
+	case "muxMaxStreams":
+		return parseInt(val, 1, &state.database.muxMaxStreams)
+	case "muxWindow":
+		return parseInt(val, 1, &state.database.muxWindow)
+	case "bandTimeout":
+		return parseInt(val, 1, &state.database.bandTimeout)
+	case "bandQueueDepth":
+		return parseInt(val, 1, &state.database.bandQueueDepth)
+	case "handshakeWorkers":
+		return parseInt(val, 1, &state.database.handshakeWorkers)
+	case "maxHandshakes":
+		return parseInt(val, 1, &state.database.maxHandshakes)
+	case "maxHandshakesPerIp":
+		return parseInt(val, 1, &state.database.maxHandshakesPerIp)
+	case "balanceStrategy":
+		return parseBalanceStrategy(val, &state.database.balanceStrategy)
 	case "timeout":
-		items.database.timeout = valn
+		return parseInt(val, 1, &state.database.timeout)
 	case "timeoutReadHeader":
-		items.database.timeoutReadHeader = valn
+		return parseInt(val, 0, &state.database.timeoutReadHeader)
 	case "timeoutRead":
-		items.database.timeoutRead = valn
+		return parseInt(val, 0, &state.database.timeoutRead)
 	case "timeoutWrite":
-		items.database.timeoutWrite = valn
+		return parseInt(val, 0, &state.database.timeoutWrite)
 	case "timeoutIdle":
-		items.database.timeoutIdle = valn
+		return parseInt(val, 0, &state.database.timeoutIdle)
+	case "timeoutDrain":
+		return parseInt(val, 0, &state.database.timeoutDrain)
+	default:
+		return unknownKeyError(key)
+	}
+	return nil
+}
+
+/* parseInt parses an integer that must be at least min, and stores it in
+ * result. On error, result is left unchanged.
+ */
+func parseInt(val string, min int, result *int) (err error) {
+	valn, err := strconv.Atoi(val)
+	if err != nil {
+		return errors.New("invalid integer " + val)
+	}
+	if valn < min {
+		return errors.New(
+			"value " + val + " is out of range, must be at least " +
+				strconv.Itoa(min))
 	}
+	*result = valn
+	return nil
 }
 
-func parseAlias(key string, val string) {
+/* parsePort parses a TCP port number, and stores it in result. On error,
+ * result is left unchanged.
+ */
+func parsePort(val string, result *int) (err error) {
+	valn, err := strconv.Atoi(val)
+	if err != nil {
+		return errors.New("invalid port number " + val)
+	}
+	if valn < 1 || valn > 65535 {
+		return errors.New(
+			"port " + val + " is out of range, must be between 1 " +
+				"and 65535")
+	}
+	*result = valn
+	return nil
+}
+
+/* parseAlias parses the value of an alias command.
+ */
+func (state *parser) parseAlias(key string, val string) (err error) {
 	aliasSplit := strings.SplitN(val, "->", 2)
 	if len(aliasSplit) < 2 {
-		return
+		return errors.New(
+			"malformed alias, expected <pattern> -> <value>")
 	}
 	left := strings.TrimSpace(aliasSplit[0])
 	right := strings.TrimSpace(aliasSplit[1])
 
-	if len(left) < 1 || len(right) < 1 {
-		return
+	if len(left) < 1 {
+		return errors.New("malformed alias, pattern is empty")
+	}
+	if len(right) < 1 {
+		return errors.New("malformed alias, value is empty")
+	}
+	if strings.ContainsAny(right, " \t") {
+		return errors.New("malformed alias, value contains spaces")
 	}
 
 	if left == "(fallback)" {
-		aliases.fallback = right
-	} else {
-		aliases.database[left] = right
+		state.fallback = right
+		return nil
+	}
+
+	rule, err := newAliasRule(left, right)
+	if err != nil {
+		return err
 	}
+	state.setAlias(rule)
+	return nil
 }
 
 func ResolveAliases(input string) (output string) {
 	aliases.mutex.RLock()
 	defer aliases.mutex.RUnlock()
-
-	// try to match an alias
-	for key, value := range aliases.database {
-		if input == key {
-			return value
-		}
-	}
-
-	// if a fallback is set, and no aliases were found, use fallback
-	if aliases.fallback != "" {
-		return aliases.fallback
-	}
-
-	// if we don't have anything to resolve, return input as is
-	return input
+	return aliases.table.resolve(input)
 }
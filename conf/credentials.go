@@ -0,0 +1,270 @@
+package conf
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrWrongKey = errors.New("cell sent the wrong key")
+
+/* Client certificate modes decide whether cells connecting to the hlhv port
+ * must present a certificate signed by the configured CA. With
+ * ClientCertOptional, certificates are checked if cells present them, but
+ * cells may still log in with a key instead.
+ */
+const (
+	ClientCertOff      = "off"
+	ClientCertOptional = "optional"
+	ClientCertRequired = "required"
+)
+
+/* CertCredential is the credential of cells whose identity was taken from
+ * their client certificate.
+ */
+const CertCredential = "(certificate)"
+
+/* connKeyIdentity is how cells that logged in with connKey are referred to in
+ * the config file, and anyIdentity refers to every cell.
+ */
+const (
+	connKeyIdentity = "(connKey)"
+	anyIdentity     = "*"
+)
+
+/* parseCellKey parses the value of a cellKey command, which gives a single
+ * cell identity a passkey of its own.
+ */
+func (state *parser) parseCellKey(val string) (err error) {
+	fields := strings.Fields(val)
+	if len(fields) != 2 {
+		return errors.New("malformed cellKey, expected <name> <hash>")
+	}
+
+	_, err = bcrypt.Cost([]byte(fields[1]))
+	if err != nil {
+		return errors.New("cellKey for " + fields[0] +
+			" is not a valid bcrypt hash")
+	}
+
+	state.cellKeys[fields[0]] = fields[1]
+	return nil
+}
+
+/* dummyHash is compared against when a cell has no key to be checked against,
+ * so that logging in takes as long whether or not a key exists.
+ */
+var dummyHash struct {
+	hash []byte
+	once sync.Once
+}
+
+/* CheckCellKey checks the passkey a cell logged in with. If a cellKey has the
+ * same name the cell gave itself, the passkey is checked against that key only.
+ * Otherwise, it is checked against connKey. Either way, bcrypt is only run
+ * once. It returns the name of the identity the key belongs to, which is empty
+ * for connKey, and the hash the key matched, which can later be given to
+ * CheckCredential. If no keys are configured at all, every cell is let in.
+ */
+func CheckCellKey(
+	key string,
+	name string,
+) (
+	identity string,
+	credential string,
+	err error,
+) {
+	items.mutex.RLock()
+	connKey := items.database.connKey
+	cellKey, named := items.cellKeys[name]
+	anyKeys := connKey != "" || len(items.cellKeys) > 0
+	items.mutex.RUnlock()
+
+	if !anyKeys {
+		return "", "", nil
+	}
+
+	switch {
+	case named:
+		identity, credential = name, cellKey
+	case connKey != "":
+		identity, credential = "", connKey
+	default:
+		dummyHash.once.Do(func() {
+			dummyHash.hash, _ = bcrypt.GenerateFromPassword(
+				[]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash.hash, []byte(key))
+		return "", "", ErrWrongKey
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(credential), []byte(key))
+	if err != nil {
+		return "", "", ErrWrongKey
+	}
+	return identity, credential, nil
+}
+
+/* CheckCredential returns whether a cell that logged in as identity, with a key
+ * that matched credential, would still be let in by the current configuration.
+ * This is false once its key has been changed or removed, or once client
+ * certificates are required. Cells that were identified by their certificate
+ * stay valid as long as client certificates are not turned off.
+ */
+func CheckCredential(identity string, credential string) (valid bool) {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+
+	if credential == CertCredential {
+		return items.database.clientCert != ClientCertOff
+	}
+	if items.database.clientCert == ClientCertRequired {
+		return false
+	}
+	if identity != "" {
+		return items.cellKeys[identity] == credential
+	}
+	if credential == "" {
+		return items.database.connKey == "" && len(items.cellKeys) == 0
+	}
+	return items.database.connKey == credential
+}
+
+/* diffCellKeys describes which cellKeys have been added, changed, or removed.
+ * The keys themselves are never included.
+ */
+func (state *parser) diffCellKeys() (changes []string) {
+	names := []string{}
+	for name := range items.cellKeys {
+		names = append(names, name)
+	}
+	for name := range state.cellKeys {
+		if _, exists := items.cellKeys[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldHash, oldExists := items.cellKeys[name]
+		newHash, newExists := state.cellKeys[name]
+
+		switch {
+		case !newExists:
+			changes = append(changes, "cellKey "+name+" removed")
+		case !oldExists:
+			changes = append(changes, "cellKey "+name+" added")
+		case oldHash != newHash:
+			changes = append(changes, "cellKey "+name+" changed")
+		}
+	}
+	return changes
+}
+
+/* parseClientCert checks that val is a client certificate mode, and stores it
+ * in result. On error, result is left unchanged.
+ */
+func parseClientCert(val string, result *string) (err error) {
+	switch val {
+	case ClientCertOff, ClientCertOptional, ClientCertRequired:
+		*result = val
+		return nil
+	default:
+		return errors.New(
+			"unknown client certificate mode " + val + ", must " +
+				"be one of " + ClientCertOff + ", " +
+				ClientCertOptional + ", " + ClientCertRequired)
+	}
+}
+
+/* parseAllowMount parses the value of an allowMount command, which lets a
+ * single cell identity mount patterns starting with a prefix.
+ */
+func (state *parser) parseAllowMount(val string) (err error) {
+	fields := strings.Fields(val)
+	if len(fields) != 2 {
+		return errors.New(
+			"malformed allowMount, expected <identity> <prefix>")
+	}
+
+	identity := fields[0]
+	if identity == connKeyIdentity {
+		identity = ""
+	}
+	state.allowMounts[identity] = append(
+		state.allowMounts[identity], fields[1])
+	return nil
+}
+
+/* CheckMount returns whether a cell with the given identity may mount a
+ * pattern. If no allowMount commands are configured, every cell may mount
+ * anything. Otherwise, the pattern must start with a prefix allowed for the
+ * identity, or for every identity.
+ */
+func CheckMount(identity string, pattern string) (allowed bool) {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+
+	if len(items.allowMounts) == 0 {
+		return true
+	}
+
+	for _, prefix := range items.allowMounts[identity] {
+		if strings.HasPrefix(pattern, prefix) {
+			return true
+		}
+	}
+	for _, prefix := range items.allowMounts[anyIdentity] {
+		if strings.HasPrefix(pattern, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/* diffAllowMounts describes which allowMount commands have been added or
+ * removed.
+ */
+func (state *parser) diffAllowMounts() (changes []string) {
+	oldRules := allowMountRules(items.allowMounts)
+	newRules := allowMountRules(state.allowMounts)
+
+	rules := []string{}
+	for rule := range oldRules {
+		rules = append(rules, rule)
+	}
+	for rule := range newRules {
+		if !oldRules[rule] {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Strings(rules)
+
+	for _, rule := range rules {
+		switch {
+		case !newRules[rule]:
+			changes = append(changes, "allowMount "+rule+" removed")
+		case !oldRules[rule]:
+			changes = append(changes, "allowMount "+rule+" added")
+		}
+	}
+	return changes
+}
+
+/* allowMountRules lists every allowMount command in a set, written as
+ * "<identity> <prefix>".
+ */
+func allowMountRules(allowMounts map[string][]string) (rules map[string]bool) {
+	rules = make(map[string]bool)
+	for identity, prefixes := range allowMounts {
+		if identity == "" {
+			identity = connKeyIdentity
+		}
+		for _, prefix := range prefixes {
+			rules[identity+" "+prefix] = true
+		}
+	}
+	return rules
+}
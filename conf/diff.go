@@ -0,0 +1,126 @@
+package conf
+
+import (
+	"sort"
+	"strconv"
+)
+
+/* entry is a single named configuration item, formatted as a string.
+ */
+type entry struct {
+	key   string
+	value string
+}
+
+/* entries lists every configuration item in the database, in a fixed order.
+ */
+func (database *databaseType) entries() []entry {
+	return []entry{
+		{"keyPath", database.keyPath},
+		{"certPath", database.certPath},
+		{"connKey", database.connKey},
+		{"clientCert", database.clientCert},
+		{"clientCaPath", database.clientCaPath},
+		{"portHlhv", strconv.Itoa(database.portHlhv)},
+		{"portHttps", strconv.Itoa(database.portHttps)},
+		{"gardenFreq", strconv.Itoa(database.gardenFreq)},
+		{"maxBandAge", strconv.Itoa(database.maxBandAge)},
+		{"minBands", strconv.Itoa(database.minBands)},
+		{"maxBands", strconv.Itoa(database.maxBands)},
+		{"heartbeatFreq", strconv.Itoa(database.heartbeatFreq)},
+		{"heartbeatMisses", strconv.Itoa(database.heartbeatMisses)},
+		{"bodyChunkSize", strconv.Itoa(database.bodyChunkSize)},
+		{"tunnelIdleTimeout", strconv.Itoa(database.tunnelIdleTimeout)},
+		{"muxMaxStreams", strconv.Itoa(database.muxMaxStreams)},
+		{"muxWindow", strconv.Itoa(database.muxWindow)},
+		{"balanceStrategy", database.balanceStrategy},
+		{"bandTimeout", strconv.Itoa(database.bandTimeout)},
+		{"bandQueueDepth", strconv.Itoa(database.bandQueueDepth)},
+		{"handshakeWorkers", strconv.Itoa(database.handshakeWorkers)},
+		{"maxHandshakes", strconv.Itoa(database.maxHandshakes)},
+		{"maxHandshakesPerIp", strconv.Itoa(database.maxHandshakesPerIp)},
+		{"timeout", strconv.Itoa(database.timeout)},
+		{"timeoutReadHeader", strconv.Itoa(database.timeoutReadHeader)},
+		{"timeoutRead", strconv.Itoa(database.timeoutRead)},
+		{"timeoutWrite", strconv.Itoa(database.timeoutWrite)},
+		{"timeoutIdle", strconv.Itoa(database.timeoutIdle)},
+		{"timeoutDrain", strconv.Itoa(database.timeoutDrain)},
+	}
+}
+
+/* diff compares the parser's state to the active configuration, and returns a
+ * human readable description of every difference between them. Secrets are
+ * not included in the output.
+ */
+func (state *parser) diff() (changes []string) {
+	items.mutex.RLock()
+	aliases.mutex.RLock()
+	defer aliases.mutex.RUnlock()
+	defer items.mutex.RUnlock()
+
+	oldEntries := items.database.entries()
+	newEntries := state.database.entries()
+	for index, oldEntry := range oldEntries {
+		newEntry := newEntries[index]
+		if oldEntry.value == newEntry.value {
+			continue
+		}
+
+		if oldEntry.key == "connKey" {
+			changes = append(changes, "connKey changed")
+			continue
+		}
+
+		changes = append(changes,
+			oldEntry.key+" "+oldEntry.value+" -> "+newEntry.value)
+	}
+
+	changes = append(changes, state.diffPatterns()...)
+	changes = append(changes, state.diffCellKeys()...)
+	changes = append(changes, state.diffAllowMounts()...)
+
+	if aliases.table.fallback != state.fallback {
+		changes = append(changes,
+			"alias (fallback) -> "+state.fallback+
+				" (was "+aliases.table.fallback+")")
+	}
+
+	oldAliases := make(map[string]string)
+	for _, rule := range aliases.rules {
+		oldAliases[rule.pattern] = rule.value
+	}
+	newAliases := make(map[string]string)
+	for _, rule := range state.aliases {
+		newAliases[rule.pattern] = rule.value
+	}
+
+	patterns := []string{}
+	for pattern := range oldAliases {
+		patterns = append(patterns, pattern)
+	}
+	for pattern := range newAliases {
+		if _, exists := oldAliases[pattern]; !exists {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		oldValue, oldExists := oldAliases[pattern]
+		newValue, newExists := newAliases[pattern]
+
+		switch {
+		case !newExists:
+			changes = append(changes, "unalias "+pattern)
+		case !oldExists:
+			changes = append(changes,
+				"alias "+pattern+" -> "+newValue)
+		case oldValue != newValue:
+			changes = append(changes,
+				"alias "+pattern+" -> "+newValue+
+					" (was "+oldValue+")")
+		}
+	}
+
+	return changes
+}
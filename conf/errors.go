@@ -0,0 +1,44 @@
+package conf
+
+import (
+	"strconv"
+	"strings"
+)
+
+/* ParseError describes a single problem found in a config file, and where it
+ * was found.
+ */
+type ParseError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (err *ParseError) Error() string {
+	if err.Line == 0 {
+		return err.File + ": " + err.Message
+	}
+	return err.File + ":" + strconv.Itoa(err.Line) + ":" +
+		strconv.Itoa(err.Column) + ": " + err.Message
+}
+
+/* ParseErrors is a list of every problem found in a config file.
+ */
+type ParseErrors []*ParseError
+
+func (errs ParseErrors) Error() string {
+	messages := make([]string, len(errs))
+	for index, err := range errs {
+		messages[index] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+/* unknownKeyError is returned when a key in a config file is not recognized.
+ */
+type unknownKeyError string
+
+func (err unknownKeyError) Error() string {
+	return "unknown key " + string(err)
+}
@@ -1,56 +1,163 @@
 package conf
 
-import "golang.org/x/crypto/bcrypt"
-
 func GetKeyPath() string {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.keyPath
 }
 
 func GetCertPath() string {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.certPath
 }
 
-func CheckConnKey(against string) (err error) {
-	if items.database.connKey == "" {
-		return nil
-	}
-	return bcrypt.CompareHashAndPassword(
-		[]byte(items.database.connKey),
-		[]byte(against))
+func GetClientCert() string {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.clientCert
+}
+
+func GetClientCaPath() string {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.clientCaPath
 }
 
 func GetPortHlhv() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.portHlhv
 }
 
 func GetPortHttps() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.portHttps
 }
 
 func GetGardenFreq() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.gardenFreq
 }
 
 func GetMaxBandAge() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.maxBandAge
 }
 
+func GetMinBands() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.minBands
+}
+
+func GetMaxBands() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.maxBands
+}
+
+func GetHeartbeatFreq() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.heartbeatFreq
+}
+
+func GetHeartbeatMisses() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.heartbeatMisses
+}
+
+func GetBodyChunkSize() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.bodyChunkSize
+}
+
+func GetTunnelIdleTimeout() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.tunnelIdleTimeout
+}
+
+func GetMuxMaxStreams() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.muxMaxStreams
+}
+
+func GetMuxWindow() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.muxWindow
+}
+
+func GetBandTimeout() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.bandTimeout
+}
+
+func GetBandQueueDepth() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.bandQueueDepth
+}
+
+func GetHandshakeWorkers() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.handshakeWorkers
+}
+
+func GetMaxHandshakes() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.maxHandshakes
+}
+
+func GetMaxHandshakesPerIp() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.maxHandshakesPerIp
+}
+
 func GetTimeout() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.timeout
 }
 
 func GetTimeoutReadHeader() int {
-	return items.database.timeout
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.timeoutReadHeader
 }
 
 func GetTimeoutRead() int {
-	return items.database.timeout
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.timeoutRead
 }
 
 func GetTimeoutWrite() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.timeoutWrite
 }
 
 func GetTimeoutIdle() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
 	return items.database.timeoutIdle
 }
+
+func GetTimeoutDrain() int {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+	return items.database.timeoutDrain
+}
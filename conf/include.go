@@ -0,0 +1,100 @@
+package conf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* parse reads the config file at confpath into the parser, followed by every
+ * file in the conf.d directory next to it in lexical order, followed by
+ * overrides from the environment and command line. If the main file cannot be
+ * read, that error is returned directly. Otherwise, every problem found is
+ * collected, and returned together as ParseErrors.
+ */
+func (state *parser) parse(confpath string) (err error) {
+	err = state.parseFile(canonicalPath(confpath))
+	if err != nil {
+		return err
+	}
+
+	confDir := filepath.Join(filepath.Dir(confpath), "conf.d")
+	matches, err := filepath.Glob(filepath.Join(confDir, "*.conf"))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		err = state.parseFile(canonicalPath(match))
+		if err != nil {
+			state.addError(match, 0, 0, err.Error())
+		}
+	}
+
+	return state.parseOverrides()
+}
+
+/* include reads every file matching pattern into the parser, in lexical
+ * order. Relative patterns are resolved from the directory of the file that
+ * included them. A pattern without any glob characters must match an existing
+ * file.
+ */
+func (state *parser) include(from string, pattern string) (err error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from), pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return errors.New("malformed include pattern " + pattern)
+	}
+
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return errors.New("included file " + pattern + " does not exist")
+	}
+
+	for _, match := range matches {
+		match = canonicalPath(match)
+
+		for index, including := range state.includeStack {
+			if including != match {
+				continue
+			}
+			cycle := append([]string{}, state.includeStack[index:]...)
+			cycle = append(cycle, match)
+			return errors.New(
+				"include cycle: " + strings.Join(cycle, " -> "))
+		}
+
+		info, err := os.Stat(match)
+		if err == nil && info.IsDir() {
+			return errors.New("included file " + match +
+				" is a directory")
+		}
+
+		err = state.parseFile(match)
+		if err != nil {
+			return errors.New(
+				"could not include " + match + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+/* canonicalPath returns an absolute path with all symbolic links resolved, so
+ * that the same file is always referred to by the same path. If that cannot be
+ * done, the path is returned cleaned but otherwise unchanged.
+ */
+func canonicalPath(path string) string {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(absolute)
+	if err != nil {
+		return absolute
+	}
+	return resolved
+}
@@ -0,0 +1,105 @@
+package conf
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+/* Configuration items are taken from, in order of increasing precedence: the
+ * defaults, the config file, environment variables, and command line flags.
+ */
+
+var flagOverrides struct {
+	values map[string]string
+	mutex  sync.RWMutex
+}
+
+/* Keys returns the name of every configuration item that can be overridden.
+ */
+func Keys() (keys []string) {
+	for _, entry := range (&databaseType{}).entries() {
+		keys = append(keys, entry.key)
+	}
+	return keys
+}
+
+/* EnvName returns the environment variable that overrides a configuration
+ * item. For example, the environment variable for portHttps is
+ * HLHV_PORT_HTTPS.
+ */
+func EnvName(key string) string {
+	return "HLHV_" + strings.ToUpper(splitWords(key, "_"))
+}
+
+/* FlagName returns the command line flag that overrides a configuration item,
+ * without leading dashes. For example, the flag for portHttps is port-https.
+ */
+func FlagName(key string) string {
+	return strings.ToLower(splitWords(key, "-"))
+}
+
+/* SetFlagOverrides sets the values given for configuration items on the
+ * command line. These take precedence over everything else, and are kept
+ * across reloads.
+ */
+func SetFlagOverrides(values map[string]string) {
+	flagOverrides.mutex.Lock()
+	defer flagOverrides.mutex.Unlock()
+	flagOverrides.values = values
+}
+
+/* parseOverrides applies environment variables and then command line flags to
+ * the parser, and returns every problem found while parsing, including those
+ * found earlier in config files.
+ */
+func (state *parser) parseOverrides() (err error) {
+	flagOverrides.mutex.RLock()
+	defer flagOverrides.mutex.RUnlock()
+
+	for _, key := range Keys() {
+		envName := EnvName(key)
+		val, exists := os.LookupEnv(envName)
+		if exists {
+			state.handleOverride(key, val, "environment "+envName)
+		}
+	}
+
+	for _, key := range Keys() {
+		val, exists := flagOverrides.values[key]
+		if exists {
+			state.handleOverride(key, val, "flag --"+FlagName(key))
+		}
+	}
+
+	if len(state.errors) > 0 {
+		return state.errors
+	}
+	return nil
+}
+
+/* handleOverride sets a single configuration item from outside of a config
+ * file, and records where it came from.
+ */
+func (state *parser) handleOverride(key string, val string, source string) {
+	err := state.handleKeyVal(key, strings.TrimSpace(val))
+	if err != nil {
+		state.addError(source, 0, 0, err.Error())
+		return
+	}
+	state.sources[key] = source
+}
+
+/* splitWords splits a camel case key into words, and joins them with sep.
+ */
+func splitWords(key string, sep string) string {
+	var builder strings.Builder
+	for index, ch := range key {
+		if index > 0 && unicode.IsUpper(ch) {
+			builder.WriteString(sep)
+		}
+		builder.WriteRune(ch)
+	}
+	return builder.String()
+}
@@ -0,0 +1,332 @@
+package conf
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Balancing strategies decide which cell in a pool of cells mounted on the
+ * same pattern is given each request.
+ */
+const (
+	BalanceRoundRobin    = "roundRobin"
+	BalanceLeastRequests = "leastRequests"
+	BalanceRandomTwo     = "randomTwo"
+)
+
+/* Pin sources decide where a request can ask to be handled by a specific
+ * version of a cell.
+ */
+const (
+	PinNone   = ""
+	PinCookie = "cookie"
+	PinHeader = "header"
+)
+
+/* Affinities decide how requests from the same client are kept on the same
+ * cell in a pool. AffinityCookie gives the client a cookie naming the cell,
+ * and the others hash a cookie, a header, or the client's IP address.
+ */
+const (
+	AffinityNone       = ""
+	AffinityCookie     = "cookie"
+	AffinityCookieHash = "cookieHash"
+	AffinityHeader     = "header"
+	AffinityIp         = "ip"
+)
+
+/* noVersion is how cells that did not give a version are referred to in the
+ * config file.
+ */
+const noVersion = "(none)"
+
+/* patternItems holds settings that only apply to a single mount pattern.
+ * Empty fields fall back to the global setting.
+ */
+type patternItems struct {
+	balance string
+
+	pinSource string
+	pinName   string
+
+	affinity     string
+	affinityName string
+
+	// weights set for each version, overriding those given by cells
+	weights map[string]int
+}
+
+/* entries lists every setting for the pattern.
+ */
+func (pattern *patternItems) entries() (entries []entry) {
+	entries = append(entries, entry{"balance", pattern.balance})
+	if pattern.pinSource != PinNone {
+		entries = append(entries, entry{
+			"pinVersion", pattern.pinSource + " " + pattern.pinName,
+		})
+	}
+	if pattern.affinity != AffinityNone {
+		entries = append(entries, entry{
+			"affinity", pattern.affinity + " " + pattern.affinityName,
+		})
+	}
+	for version, weight := range pattern.weights {
+		entries = append(entries, entry{
+			"weight " + version, strconv.Itoa(weight),
+		})
+	}
+	return entries
+}
+
+/* patternItem returns the settings for a pattern in the parser, creating them
+ * if they do not exist yet.
+ */
+func (state *parser) patternItem(pattern string) *patternItems {
+	item, exists := state.patterns[pattern]
+	if !exists {
+		item = &patternItems{weights: make(map[string]int)}
+		state.patterns[pattern] = item
+	}
+	return item
+}
+
+/* parseBalance parses the value of a balance command, which sets the balancing
+ * strategy for a single pattern.
+ */
+func (state *parser) parseBalance(val string) (err error) {
+	fields := strings.Fields(val)
+	if len(fields) != 2 {
+		return errors.New(
+			"malformed balance, expected <pattern> <strategy>")
+	}
+
+	item := state.patternItem(fields[0])
+	return parseBalanceStrategy(fields[1], &item.balance)
+}
+
+/* parseWeight parses the value of a weight command, which sets the share of
+ * traffic a version of a cell receives on a single pattern.
+ */
+func (state *parser) parseWeight(val string) (err error) {
+	fields := strings.Fields(val)
+	if len(fields) != 3 {
+		return errors.New(
+			"malformed weight, expected <pattern> <version> <weight>")
+	}
+
+	weight := 0
+	err = parseInt(fields[2], 0, &weight)
+	if err != nil {
+		return err
+	}
+
+	version := fields[1]
+	if version == noVersion {
+		version = ""
+	}
+	state.patternItem(fields[0]).weights[version] = weight
+	return nil
+}
+
+/* parsePinVersion parses the value of a pinVersion command, which lets
+ * requests to a single pattern choose which version of a cell handles them.
+ */
+func (state *parser) parsePinVersion(val string) (err error) {
+	fields := strings.Fields(val)
+	if len(fields) != 3 {
+		return errors.New(
+			"malformed pinVersion, expected <pattern> cookie|header " +
+				"<name>")
+	}
+
+	if fields[1] != PinCookie && fields[1] != PinHeader {
+		return errors.New(
+			"unknown pin source " + fields[1] + ", must be " +
+				PinCookie + " or " + PinHeader)
+	}
+
+	item := state.patternItem(fields[0])
+	item.pinSource = fields[1]
+	item.pinName = fields[2]
+	return nil
+}
+
+/* parseAffinity parses the value of an affinity command, which decides how
+ * requests from the same client to a single pattern are kept on the same cell.
+ */
+func (state *parser) parseAffinity(val string) (err error) {
+	fields := strings.Fields(val)
+	if len(fields) < 2 || len(fields) > 3 {
+		return errors.New(
+			"malformed affinity, expected <pattern> <kind> [name]")
+	}
+
+	name := ""
+	if len(fields) == 3 {
+		name = fields[2]
+	}
+
+	err = CheckAffinity(fields[1], name)
+	if err != nil {
+		return err
+	}
+
+	item := state.patternItem(fields[0])
+	item.affinity = fields[1]
+	item.affinityName = name
+	return nil
+}
+
+/* CheckAffinity returns an error if affinity is not a known kind of affinity,
+ * or if it requires a cookie or header name that was not given.
+ */
+func CheckAffinity(affinity string, name string) (err error) {
+	switch affinity {
+	case AffinityNone, AffinityCookie, AffinityIp:
+		return nil
+	case AffinityCookieHash, AffinityHeader:
+		if name == "" {
+			return errors.New(
+				"affinity " + affinity + " requires a name")
+		}
+		return nil
+	default:
+		return errors.New(
+			"unknown affinity " + affinity + ", must be one of " +
+				AffinityCookie + ", " + AffinityCookieHash + ", " +
+				AffinityHeader + ", " + AffinityIp)
+	}
+}
+
+/* parseBalanceStrategy checks that val is the name of a balancing strategy,
+ * and stores it in result. On error, result is left unchanged.
+ */
+func parseBalanceStrategy(val string, result *string) (err error) {
+	switch val {
+	case BalanceRoundRobin, BalanceLeastRequests, BalanceRandomTwo:
+		*result = val
+		return nil
+	default:
+		return errors.New(
+			"unknown balancing strategy " + val + ", must be one " +
+				"of " + BalanceRoundRobin + ", " +
+				BalanceLeastRequests + ", " + BalanceRandomTwo)
+	}
+}
+
+/* diffPatterns describes every difference between the per-pattern settings in
+ * the parser and the active ones.
+ */
+func (state *parser) diffPatterns() (changes []string) {
+	names := []string{}
+	for name := range items.patterns {
+		names = append(names, name)
+	}
+	for name := range state.patterns {
+		if _, exists := items.patterns[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	empty := &patternItems{}
+	for _, name := range names {
+		oldItem, exists := items.patterns[name]
+		if !exists {
+			oldItem = empty
+		}
+		newItem, exists := state.patterns[name]
+		if !exists {
+			newItem = empty
+		}
+
+		oldValues := make(map[string]string)
+		for _, oldEntry := range oldItem.entries() {
+			oldValues[oldEntry.key] = oldEntry.value
+		}
+		newValues := make(map[string]string)
+		for _, newEntry := range newItem.entries() {
+			newValues[newEntry.key] = newEntry.value
+		}
+
+		keys := []string{}
+		for key := range oldValues {
+			keys = append(keys, key)
+		}
+		for key := range newValues {
+			if _, exists := oldValues[key]; !exists {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if oldValues[key] == newValues[key] {
+				continue
+			}
+			changes = append(changes,
+				key+" "+name+" "+oldValues[key]+
+					" -> "+newValues[key])
+		}
+	}
+
+	return changes
+}
+
+/* GetBalanceStrategy returns the balancing strategy used for a pattern.
+ */
+func GetBalanceStrategy(pattern string) string {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+
+	item, exists := items.patterns[pattern]
+	if exists && item.balance != "" {
+		return item.balance
+	}
+	return items.database.balanceStrategy
+}
+
+/* GetVersionWeight returns the weight set in the config file for a version of
+ * a cell mounted on a pattern, and whether one was set at all.
+ */
+func GetVersionWeight(pattern string, version string) (weight int, set bool) {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+
+	item, exists := items.patterns[pattern]
+	if !exists {
+		return 0, false
+	}
+	weight, set = item.weights[version]
+	return weight, set
+}
+
+/* GetVersionPin returns where requests to a pattern can ask for a specific
+ * version of a cell, and the name of the cookie or header to look at.
+ */
+func GetVersionPin(pattern string) (source string, name string) {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+
+	item, exists := items.patterns[pattern]
+	if !exists {
+		return PinNone, ""
+	}
+	return item.pinSource, item.pinName
+}
+
+/* GetAffinity returns how requests to a pattern are kept on the same cell, and
+ * the name of the cookie or header involved, if it was set in the config file.
+ */
+func GetAffinity(pattern string) (affinity string, name string) {
+	items.mutex.RLock()
+	defer items.mutex.RUnlock()
+
+	item, exists := items.patterns[pattern]
+	if !exists {
+		return AffinityNone, ""
+	}
+	return item.affinity, item.affinityName
+}
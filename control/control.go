@@ -0,0 +1,237 @@
+package control
+
+import (
+	"bufio"
+	"errors"
+	"github.com/hlhv/scribe"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Handler is a function that carries out a control command. It is given the
+ * arguments that followed the command name, and returns text that will be sent
+ * back to the client.
+ */
+type Handler func(args []string) (reply string, err error)
+
+var path string
+var listening bool
+var stopNotify chan int
+var server net.Listener
+
+var handlers struct {
+	lookup map[string]Handler
+	mutex  sync.RWMutex
+}
+
+/* Register makes a control command available under the given name. Commands
+ * may be registered at any time, including while the control socket is
+ * listening.
+ */
+func Register(name string, handler Handler) {
+	handlers.mutex.Lock()
+	defer handlers.mutex.Unlock()
+
+	if handlers.lookup == nil {
+		handlers.lookup = make(map[string]Handler)
+	}
+	handlers.lookup[name] = handler
+}
+
+/* Arm prepares the control socket at the given path. If a stale socket is left
+ * over from a previous run, it is removed.
+ */
+func Arm(socketPath string) (err error) {
+	path = socketPath
+	server = nil
+	scribe.PrintProgress(
+		scribe.LogLevelNormal,
+		"arming control socket at", path)
+
+	// only remove what is actually a socket, never a regular file
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return errors.New(path + " exists and is not a socket")
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	// only the user running the queen may control it
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	server = listener
+	return nil
+}
+
+/* Fire is supposed to be run in a separate goroutine, and handles incoming
+ * connections on the control socket. Each connection carries exactly one
+ * command. This function will only run after the control socket has been
+ * Arm()'d. If arming failed, or never happened, it returns straight away.
+ */
+func Fire() {
+	if server == nil {
+		scribe.PrintWarning(
+			scribe.LogLevelError,
+			"control socket is not armed, not listening")
+		return
+	}
+
+	scribe.PrintInfo(
+		scribe.LogLevelDebug,
+		"control socket listening")
+	listening = true
+	defer func() {
+		listening = false
+		scribe.PrintInfo(
+			scribe.LogLevelDebug,
+			"control socket no longer listening")
+	}()
+
+	for {
+		conn, err := server.Accept()
+
+		// if we are stopping, exit cleanly
+		if stopNotify != nil {
+			stopNotify <- 0
+			return
+		}
+
+		if err != nil {
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"control accept:", err)
+			return
+		}
+
+		go handleConn(conn)
+	}
+}
+
+/* Close stops the control socket from accepting new commands, and removes the
+ * socket file.
+ */
+func Close() {
+	if !listening {
+		return
+	}
+
+	scribe.PrintProgress(scribe.LogLevelNormal, "stopping control socket")
+	stopNotify = make(chan int)
+	server.Close()
+	<-stopNotify
+	scribe.PrintDone(scribe.LogLevelNormal, "stopped control socket")
+}
+
+/* handleConn reads a single command from a connection, runs it, and writes the
+ * result back. The first line of the reply is either "ok" or "err", and the
+ * rest of the reply is the output of the command.
+ */
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		scribe.PrintError(scribe.LogLevelError, "control read:", err)
+		return
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		io.WriteString(conn, "err\nempty command\n")
+		return
+	}
+
+	scribe.PrintInfo(
+		scribe.LogLevelNormal,
+		"control command:", strings.Join(fields, " "))
+
+	handlers.mutex.RLock()
+	handler, exists := handlers.lookup[fields[0]]
+	handlers.mutex.RUnlock()
+
+	if !exists {
+		io.WriteString(conn,
+			"err\nunknown command "+fields[0]+", try: "+
+				strings.Join(commandNames(), ", ")+"\n")
+		return
+	}
+
+	reply, err := handler(fields[1:])
+	if err != nil {
+		io.WriteString(conn, "err\n"+err.Error()+"\n")
+		return
+	}
+
+	if reply != "" && !strings.HasSuffix(reply, "\n") {
+		reply += "\n"
+	}
+	io.WriteString(conn, "ok\n"+reply)
+}
+
+/* commandNames returns a sorted list of every registered command.
+ */
+func commandNames() (names []string) {
+	handlers.mutex.RLock()
+	defer handlers.mutex.RUnlock()
+
+	for name := range handlers.lookup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* Send connects to a running queen's control socket, sends it a command, and
+ * returns its reply. If the queen reports that the command failed, the reply is
+ * returned as an error.
+ */
+func Send(socketPath string, command string) (reply string, err error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, command+"\n")
+	if err != nil {
+		return "", err
+	}
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	split := strings.SplitN(string(response), "\n", 2)
+	if len(split) < 2 {
+		return "", errors.New("malformed reply from control socket")
+	}
+
+	switch split[0] {
+	case "ok":
+		return split[1], nil
+	case "err":
+		return "", errors.New(strings.TrimSpace(split[1]))
+	default:
+		return "", errors.New("malformed reply from control socket")
+	}
+}
@@ -0,0 +1,46 @@
+package control
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArmUnwritablePath(test *testing.T) {
+	err := Arm("/nonexistent/dir/c.sock")
+	if err == nil {
+		test.Fatal("arming on an unwritable path should fail")
+	}
+
+	fired := make(chan struct{})
+	go func() {
+		defer close(fired)
+		Fire()
+	}()
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		test.Fatal("Fire should return when the socket is not armed")
+	}
+
+	// closing afterwards must not block or panic either
+	Close()
+}
+
+func TestArmAfterFailure(test *testing.T) {
+	err := Arm("/nonexistent/dir/c.sock")
+	if err == nil {
+		test.Fatal("arming on an unwritable path should fail")
+	}
+
+	err = Arm(filepath.Join(test.TempDir(), "c.sock"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if server == nil {
+		test.Fatal("arming should set up a listener")
+	}
+	server.Close()
+	server = nil
+}
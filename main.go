@@ -1,28 +1,56 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"github.com/hlhv/hlhv-queen/cells"
 	"github.com/hlhv/hlhv-queen/conf"
+	"github.com/hlhv/hlhv-queen/control"
 	"github.com/hlhv/hlhv-queen/srvhttps"
 	"github.com/hlhv/hlhv-queen/wrangler"
 	"github.com/hlhv/scribe"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
 func main() {
 	ParseArgs()
+
+	// if we have been asked to send a control command, do that instead
+	// of starting up
+	if options.control != "" {
+		sendControl()
+	}
+
+	// if we have been asked to check the config file, do that instead
+	// of starting up
+	if options.checkConfig {
+		checkConfig()
+	}
+
 	scribe.SetLogLevel(options.logLevel)
 
 	arm()
 	fire()
 
+	// create sighup handler
+	sighupNotify := make(chan os.Signal, 1)
+	signal.Notify(sighupNotify, syscall.SIGHUP)
+	go func() {
+		for range sighupNotify {
+			reload()
+		}
+	}()
+
 	// create sigint handler
 	sigintNotify := make(chan os.Signal, 1)
 	signal.Notify(sigintNotify, os.Interrupt, syscall.SIGTERM)
 	<-sigintNotify
 	scribe.PrintProgress(scribe.LogLevelNormal, "shutting down")
 
+	control.Close()
 	srvhttps.Close()
 	wrangler.Close()
 
@@ -37,7 +65,16 @@ func arm() {
 	scribe.PrintProgress(scribe.LogLevelNormal, "starting hlhv queen cell")
 
 	err = conf.Load(options.confPath)
-	if err != nil {
+	if parseErrors, invalid := err.(conf.ParseErrors); invalid {
+		for _, parseError := range parseErrors {
+			scribe.PrintFatal(scribe.LogLevelError, parseError)
+		}
+		scribe.PrintFatal(
+			scribe.LogLevelError,
+			"conf is invalid, refusing to start")
+		scribe.Stop()
+		os.Exit(1)
+	} else if err != nil {
 		scribe.PrintWarning(
 			scribe.LogLevelError,
 			"could not load conf: "+err.Error())
@@ -60,14 +97,97 @@ func arm() {
 			"could not arm srvhttps: "+err.Error())
 		return
 	}
+
+	control.Register("reload", func(args []string) (string, error) {
+		changes, err := reload()
+		return strings.Join(changes, "\n"), err
+	})
+	control.Register("stats", func(args []string) (string, error) {
+		lines := append(srvhttps.Stats(), cells.Stats()...)
+		lines = append(lines, wrangler.Stats()...)
+		return strings.Join(lines, "\n"), nil
+	})
+	control.Register("cells", func(args []string) (string, error) {
+		filter := ""
+		if len(args) > 0 {
+			filter = args[0]
+		}
+		return strings.Join(wrangler.ListCells(filter), "\n"), nil
+	})
+	err = control.Arm(options.controlPath)
+	if err != nil {
+		scribe.PrintWarning(
+			scribe.LogLevelError,
+			"could not arm control socket: "+err.Error())
+	}
 }
 
 func fire() {
 	scribe.PrintProgress(scribe.LogLevelNormal, "firing")
 	go wrangler.Fire()
 	go srvhttps.Fire()
+	go control.Fire()
 
 	scribe.PrintDone(
 		scribe.LogLevelNormal,
 		"startup sequence complete, resuming normal operation")
 }
+
+/* reload re-reads the config file and applies it to every running component.
+ * Connected cells are not affected. If the config file cannot be read, nothing
+ * changes.
+ */
+func reload() (changes []string, err error) {
+	changes, err = conf.Reload(options.confPath)
+	if err != nil {
+		scribe.PrintError(
+			scribe.LogLevelError,
+			"could not reload conf, keeping current config: "+
+				err.Error())
+		return nil, errors.New("could not reload conf: " + err.Error())
+	}
+
+	for _, change := range changes {
+		scribe.PrintInfo(scribe.LogLevelNormal, "conf: "+change)
+	}
+	if len(changes) == 0 {
+		scribe.PrintInfo(scribe.LogLevelNormal, "conf: no changes")
+	}
+
+	wrangler.Reload()
+	srvhttps.Reload()
+
+	scribe.PrintDone(scribe.LogLevelNormal, "reloaded conf")
+	return changes, nil
+}
+
+/* sendControl sends a command to an already running queen, prints its reply,
+ * and exits.
+ */
+func sendControl() {
+	reply, err := control.Send(options.controlPath, options.control)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hlhv: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Print(reply)
+	os.Exit(0)
+}
+
+/* checkConfig reads the config file, prints every problem found in it, and
+ * exits. The exit status is non-zero if there were any problems.
+ */
+func checkConfig() {
+	err := conf.Check(options.confPath)
+	if parseErrors, invalid := err.(conf.ParseErrors); invalid {
+		for _, parseError := range parseErrors {
+			fmt.Fprintln(os.Stderr, parseError)
+		}
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "hlhv: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(options.confPath + ": ok")
+	os.Exit(0)
+}
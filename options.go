@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"github.com/hlhv/hlhv-queen/conf"
 	"github.com/hlhv/scribe"
 	"os"
+	"strings"
 	// TODO: write custom implementation
 	"github.com/akamensky/argparse"
 )
@@ -12,6 +14,9 @@ var options struct {
 	logLevel     scribe.LogLevel
 	confPath     string
 	logDirectory string
+	controlPath  string
+	control      string
+	checkConfig  bool
 }
 
 func ParseArgs() {
@@ -40,7 +45,38 @@ func ParseArgs() {
 		Help:     "Path to the config file",
 	})
 
-	err := parser.Parse(os.Args)
+	controlPath := parser.String("", "control-path", &argparse.Options{
+		Required: false,
+		Default:  "/var/hlhv/control.sock",
+		Help:     "Path to the control socket",
+	})
+
+	control := parser.String("c", "control", &argparse.Options{
+		Required: false,
+		Help: "Send a command (such as reload) to the running queen " +
+			"cell through the control socket, and exit",
+	})
+
+	checkConfig := parser.Flag("", "check-config", &argparse.Options{
+		Required: false,
+		Help: "Check the config file for problems and exit, without " +
+			"starting the server",
+	})
+
+	// every config key can be overridden on the command line
+	confOverrides := make(map[string]*string)
+	for _, key := range conf.Keys() {
+		confOverrides[key] = parser.String(
+			"", conf.FlagName(key), &argparse.Options{
+				Required: false,
+				Help: "Override the " + key + " config key. " +
+					"This takes precedence over " +
+					conf.EnvName(key) + " and the " +
+					"config file",
+			})
+	}
+
+	err := parser.Parse(splitEmptyFlags(os.Args))
 	if err != nil {
 		fmt.Print(parser.Usage(err))
 		os.Exit(1)
@@ -63,9 +99,46 @@ func ParseArgs() {
 	}
 
 	options.confPath = *confPath
+	options.controlPath = *controlPath
+	options.control = *control
+	options.checkConfig = *checkConfig
+
+	// a flag given with an empty value, such as --client-ca-path=, still
+	// overrides its key, so only flags that were not given are left out
+	given := make(map[string]bool)
+	for _, arg := range parser.GetArgs() {
+		if arg.GetParsed() {
+			given[arg.GetLname()] = true
+		}
+	}
+
+	overrides := make(map[string]string)
+	for key, value := range confOverrides {
+		if given[conf.FlagName(key)] {
+			overrides[key] = *value
+		}
+	}
+	conf.SetFlagOverrides(overrides)
 
 	options.logDirectory = *logDirectory
 	if options.logDirectory != "" {
 		scribe.SetLogDirectory(options.logDirectory)
 	}
 }
+
+/* splitEmptyFlags rewrites flags given an empty value with an equals sign, such
+ * as --client-ca-path=, into a flag followed by an empty argument. The argument
+ * parser refuses the first form, but an empty value is a valid way to override
+ * a config key.
+ */
+func splitEmptyFlags(args []string) (split []string) {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") && strings.HasSuffix(arg, "=") &&
+			strings.Count(arg, "=") == 1 {
+			split = append(split, strings.TrimSuffix(arg, "="), "")
+			continue
+		}
+		split = append(split, arg)
+	}
+	return split
+}
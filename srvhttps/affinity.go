@@ -0,0 +1,143 @@
+package srvhttps
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/hlhv/hlhv-queen/conf"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/* Session affinity keeps requests from the same client on the same cell. It is
+ * decided by the pool when it chooses a member, and not in Cell.HandleHTTP. By
+ * the time HandleHTTP runs, the pool has already chosen the cell, and all that
+ * is left to pick is one of that cell's bands, which does not matter to a
+ * session. The pool is also the only place that knows every cell mounted on the
+ * pattern, which it needs to fall back to the balancing strategy when the cell
+ * a client was kept on has left. So affinity still applies before a band is
+ * chosen, just one step earlier.
+ */
+
+/* defaultAffinityCookie is the name of the cookie the queen gives clients to
+ * keep them on the same cell, if no name is configured.
+ */
+const defaultAffinityCookie = "hlhv-affinity"
+
+/* affinity returns how requests to the pool are kept on the same cell. The
+ * config file takes precedence over what the cells asked for when mounting.
+ */
+func (pool *pool) affinity() (affinity string, name string) {
+	affinity, name = conf.GetAffinity(pool.pattern)
+	if affinity == conf.AffinityNone {
+		for _, member := range pool.members {
+			if member.options.Affinity != conf.AffinityNone {
+				affinity = member.options.Affinity
+				name = member.options.AffinityName
+				break
+			}
+		}
+	}
+
+	if affinity == conf.AffinityCookie && name == "" {
+		name = defaultAffinityCookie
+	}
+	return affinity, name
+}
+
+/* memberByCookie returns the member named by the request's affinity cookie, or
+ * nil if there is no such cookie or the member has left the pool.
+ */
+func (pool *pool) memberByCookie(req *http.Request, name string) *poolMember {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return nil
+	}
+
+	for _, member := range pool.members {
+		if member.token == cookie.Value {
+			return member
+		}
+	}
+	return nil
+}
+
+/* affinityCookie creates a cookie that sends the client back to a member of
+ * the pool.
+ */
+func (pool *pool) affinityCookie(name string, member *poolMember) *http.Cookie {
+	path := "/"
+	slashIndex := strings.IndexRune(pool.pattern, '/')
+	if slashIndex >= 0 {
+		path = pool.pattern[slashIndex:]
+	}
+
+	return &http.Cookie{
+		Name:     name,
+		Value:    member.token,
+		Path:     path,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+/* affinityKey returns the value that decides which cell a request goes to, or
+ * an empty string if the request does not have one.
+ */
+func affinityKey(req *http.Request, affinity string, name string) string {
+	switch affinity {
+	case conf.AffinityCookieHash:
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case conf.AffinityHeader:
+		return req.Header.Get(name)
+	case conf.AffinityIp:
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	}
+	return ""
+}
+
+/* rendezvous picks the candidate with the highest hash of the key combined
+ * with its owner. The same key always picks the same candidate, and if that
+ * candidate leaves, only the keys that picked it move elsewhere.
+ */
+func rendezvous(candidates []*poolMember, key string) (chosen *poolMember) {
+	var best uint64
+	for _, candidate := range candidates {
+		score := hashString(candidate.owner + "/" + key)
+		if chosen == nil || score > best {
+			chosen = candidate
+			best = score
+		}
+	}
+	return chosen
+}
+
+/* hashString returns a 64 bit FNV-1a hash of a string.
+ */
+func hashString(input string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(input))
+	return hash.Sum64()
+}
+
+/* newAffinityToken generates a random token that identifies a pool member in
+ * affinity cookies, without revealing anything about the cell.
+ */
+func newAffinityToken() (token string, err error) {
+	buffer := make([]byte, 16)
+	_, err = rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
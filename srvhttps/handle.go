@@ -3,6 +3,7 @@ package srvhttps
 import (
 	"github.com/hlhv/scribe"
 	"net/http"
+	"strconv"
 )
 
 func WriteSysmsg(
@@ -53,6 +54,18 @@ func WriteBadGateway(res http.ResponseWriter, req *http.Request, err error) {
 			err.Error())
 }
 
+func WritePayloadTooLarge(
+	res http.ResponseWriter,
+	req *http.Request,
+	err error,
+) {
+	WriteSysmsg(
+		res, req, 413,
+		"413 - payload too large",
+		"ERR the request was refused: "+
+			err.Error())
+}
+
 func WriteServUnavail(res http.ResponseWriter, req *http.Request, err error) {
 	WriteSysmsg(
 		res, req, 503,
@@ -61,6 +74,19 @@ func WriteServUnavail(res http.ResponseWriter, req *http.Request, err error) {
 			err.Error())
 }
 
+/* WriteServUnavailRetry writes a 503 response that tells the client to try
+ * again after the given number of seconds.
+ */
+func WriteServUnavailRetry(
+	res http.ResponseWriter,
+	req *http.Request,
+	err error,
+	retryAfter int,
+) {
+	res.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	WriteServUnavail(res, req, err)
+}
+
 func WritePlaceholder(res http.ResponseWriter, req *http.Request) {
 	WriteSysmsg(
 		res, req, 200,
@@ -27,11 +27,20 @@ type HolaMux struct {
 	mutex         sync.RWMutex
 	exactEntries  map[string]muxEntry
 	sortedEntries []muxEntry // slice of entries sorted from longest to shortest.
+
+	// slice of entries with wildcard hosts, sorted from longest to shortest
+	// host, and then from longest to shortest path.
+	wildcardEntries []muxEntry
 }
 
 type muxEntry struct {
 	handler http.Handler
 	pattern string
+	pool    *pool
+
+	// for wildcard hosts, the part of the host after the *, and the path.
+	wildcardSuffix string
+	wildcardPath   string
 }
 
 /* NewHolaMux allocates and returns a new HolaMux.
@@ -186,7 +195,7 @@ func (mux *HolaMux) handlerInternal(
 	defer mux.mutex.RUnlock()
 
 	// all patterns are host specific
-	h, pattern = mux.match(host + path)
+	h, pattern = mux.match(host, path)
 
 	if h == nil {
 		scribe.PrintError(scribe.LogLevelError, "404", pattern)
@@ -196,20 +205,29 @@ func (mux *HolaMux) handlerInternal(
 	return
 }
 
-/* Find a handler on a handler map given a path string.
- * Most-specific (longest) pattern wins.
+/* Find a handler on a handler map given a host and path string.
+ * Patterns with a literal host always win over wildcard hosts. Otherwise,
+ * the most-specific (longest) host wins, and then the most-specific (longest)
+ * path.
  */
-func (mux *HolaMux) match(path string) (h http.Handler, pattern string) {
+func (mux *HolaMux) match(host, path string) (h http.Handler, pattern string) {
 	// Check for exact match first.
-	entry, matchExists := mux.exactEntries[path]
-	if matchExists {
+	entry, matchExists := mux.exactEntries[host+path]
+	if matchExists && entry.wildcardSuffix == "" {
 		return entry.handler, entry.pattern
 	}
 
 	// Check for longest valid match.  mux.es contains all patterns
 	// that end in / sorted from longest to shortest.
 	for _, entry := range mux.sortedEntries {
-		if strings.HasPrefix(path, entry.pattern) {
+		if strings.HasPrefix(host+path, entry.pattern) {
+			return entry.handler, entry.pattern
+		}
+	}
+
+	// Check for wildcard hosts last.
+	for _, entry := range mux.wildcardEntries {
+		if entry.matchWildcard(host, path) {
 			return entry.handler, entry.pattern
 		}
 	}
@@ -217,6 +235,24 @@ func (mux *HolaMux) match(path string) (h http.Handler, pattern string) {
 	return nil, ""
 }
 
+/* matchWildcard returns whether an entry with a wildcard host matches the
+ * given host and path. The wildcard must stand for at least one character, so
+ * *.example.com does not match example.com itself.
+ */
+func (entry *muxEntry) matchWildcard(host, path string) bool {
+	if len(host) <= len(entry.wildcardSuffix) ||
+		!strings.HasSuffix(host, entry.wildcardSuffix) {
+		return false
+	}
+
+	if entry.wildcardPath == path {
+		return true
+	}
+
+	return entry.wildcardPath[len(entry.wildcardPath)-1] == '/' &&
+		strings.HasPrefix(path, entry.wildcardPath)
+}
+
 /* ServeHTTP dispatches the request to the handler whose
  * pattern most closely matches the request URL.
  */
@@ -238,11 +274,17 @@ func (mux *HolaMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 /* mount registers the handler for the given pattern, resolving all aliases. If
- * the pattern is already registered, or the pattern is invalid, Mount returns
- * an error. If the pattern ends in a '/', it will match all unregistered
- * subpatterns.
+ * the pattern is already registered, the handler joins the pool of handlers
+ * serving it. If the owner already has a handler on the pattern, or the pattern
+ * is invalid, Mount returns an error. If the pattern ends in a '/', it will
+ * match all unregistered subpatterns.
  */
-func (mux *HolaMux) mount(pattern string, handler http.Handler) error {
+func (mux *HolaMux) mount(
+	pattern string,
+	owner string,
+	options MountOptions,
+	handler http.Handler,
+) error {
 	mux.mutex.Lock()
 	defer mux.mutex.Unlock()
 
@@ -262,15 +304,52 @@ func (mux *HolaMux) mount(pattern string, handler http.Handler) error {
 		return errors.New("mux: nil handler")
 	}
 
-	if _, exist := mux.exactEntries[pattern]; exist {
-		return errors.New("mux: existing mount on " + pattern)
+	slashIndex := strings.IndexRune(pattern, '/')
+	if slashIndex < 0 {
+		return errors.New(
+			"mux: invalid pattern " + pattern +
+				", must contain a path.")
+	}
+	host := pattern[:slashIndex]
+
+	if strings.Contains(host[1:], "*") ||
+		(host[0] == '*' && !strings.HasPrefix(host, "*.")) {
+		return errors.New(
+			"mux: invalid pattern " + pattern +
+				", * is only allowed as the first label of the host.")
+	}
+
+	if entry, exist := mux.exactEntries[pattern]; exist {
+		err := entry.pool.add(owner, options, handler)
+		if err != nil {
+			return err
+		}
+		scribe.PrintMount(
+			scribe.LogLevelNormal,
+			"mount on", pattern, "joined pool of", entry.pool.size())
+		return nil
 	}
 
 	if mux.exactEntries == nil {
 		mux.exactEntries = make(map[string]muxEntry)
 	}
 
-	entry := muxEntry{handler: handler, pattern: pattern}
+	entryPool := newPool(pattern)
+	err := entryPool.add(owner, options, handler)
+	if err != nil {
+		return err
+	}
+	entry := muxEntry{handler: entryPool, pattern: pattern, pool: entryPool}
+	if host[0] == '*' {
+		entry.wildcardSuffix = host[1:]
+		entry.wildcardPath = pattern[slashIndex:]
+		mux.exactEntries[pattern] = entry
+		mux.wildcardEntries = appendSortedWildcard(
+			mux.wildcardEntries, entry)
+		scribe.PrintMount(scribe.LogLevelNormal, "mount on", pattern)
+		return nil
+	}
+
 	mux.exactEntries[pattern] = entry
 	if pattern[len(pattern)-1] == '/' {
 		mux.sortedEntries = appendSorted(mux.sortedEntries, entry)
@@ -280,10 +359,12 @@ func (mux *HolaMux) mount(pattern string, handler http.Handler) error {
 	return nil
 }
 
-/* MountFunc creates a registry, and returns an error on fail
+/* MountFunc creates a registry owned by owner, and returns an error on fail
  */
 func (mux *HolaMux) MountFunc(
 	pattern string,
+	owner string,
+	options MountOptions,
 	handlerFunc func(http.ResponseWriter, *http.Request),
 ) (
 	err error,
@@ -292,7 +373,14 @@ func (mux *HolaMux) MountFunc(
 		return errors.New("mux: nil handler")
 	}
 
-	patternPath := pattern[strings.IndexRune(pattern, '/'):]
+	slashIndex := strings.IndexRune(pattern, '/')
+	if slashIndex < 0 {
+		return errors.New(
+			"mux: invalid pattern " + pattern +
+				", must contain a path.")
+	}
+
+	patternPath := pattern[slashIndex:]
 	handlerWrap := func(res http.ResponseWriter, req *http.Request) {
 		/* strip out pattern from URL. cell should receive the path as
 		 * if it began from root instead of the pattern.
@@ -306,20 +394,33 @@ func (mux *HolaMux) MountFunc(
 		handlerFunc(res, req)
 	}
 
-	return mux.mount(pattern, http.HandlerFunc(handlerWrap))
+	return mux.mount(pattern, owner, options, http.HandlerFunc(handlerWrap))
 }
 
-/* Unmount removes a registry, and returns an error on fail.
+/* Unmount removes the registry owned by owner, and returns an error on fail.
+ * The pattern itself is only removed once its pool is empty.
  */
-func (mux *HolaMux) Unmount(pattern string) error {
+func (mux *HolaMux) Unmount(pattern string, owner string) error {
 	mux.mutex.Lock()
 	defer mux.mutex.Unlock()
 
 	// delete from exact match list
-	if _, registered := mux.exactEntries[pattern]; !registered {
+	entry, registered := mux.exactEntries[pattern]
+	if !registered {
 		return errors.New(
 			"mux: pattern " + pattern + " is not mounted")
 	}
+
+	remaining, err := entry.pool.remove(owner)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		scribe.PrintUnmount(
+			scribe.LogLevelNormal,
+			"unmount from", pattern, "leaving pool of", remaining)
+		return nil
+	}
 	delete(mux.exactEntries, pattern)
 
 	// delete from sorted list, if its in there.
@@ -332,10 +433,39 @@ func (mux *HolaMux) Unmount(pattern string) error {
 	}
 	mux.sortedEntries = mux.sortedEntries[:newLen]
 
+	// delete from wildcard list, if its in there.
+	newLen = 0
+	for index, entry := range mux.wildcardEntries {
+		if entry.pattern != pattern {
+			mux.wildcardEntries[newLen] = mux.wildcardEntries[index]
+			newLen++
+		}
+	}
+	mux.wildcardEntries = mux.wildcardEntries[:newLen]
+
 	scribe.PrintUnmount(scribe.LogLevelNormal, "unmount from", pattern)
 	return nil
 }
 
+/* Stats describes every mounted pattern, and how many requests and errors each
+ * version of the cells mounted on it has handled.
+ */
+func (mux *HolaMux) Stats() (lines []string) {
+	mux.mutex.RLock()
+	defer mux.mutex.RUnlock()
+
+	patterns := make([]string, 0, len(mux.exactEntries))
+	for pattern := range mux.exactEntries {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		lines = append(lines, mux.exactEntries[pattern].pool.stats()...)
+	}
+	return lines
+}
+
 /* appendSorted appends an entry to a list of entries, inserting it into the
  * proper sorted place.
  */
@@ -356,3 +486,21 @@ func appendSorted(entries []muxEntry, entry muxEntry) []muxEntry {
 	entries[index] = entry
 	return entries
 }
+
+/* appendSortedWildcard appends an entry with a wildcard host to a list of
+ * entries, keeping it sorted from longest to shortest host, and then from
+ * longest to shortest path.
+ */
+func appendSortedWildcard(entries []muxEntry, entry muxEntry) []muxEntry {
+	entries = append(entries, entry)
+	sort.SliceStable(entries, func(left, right int) bool {
+		leftEntry := entries[left]
+		rightEntry := entries[right]
+		if len(leftEntry.wildcardSuffix) != len(rightEntry.wildcardSuffix) {
+			return len(leftEntry.wildcardSuffix) >
+				len(rightEntry.wildcardSuffix)
+		}
+		return len(leftEntry.wildcardPath) > len(rightEntry.wildcardPath)
+	})
+	return entries
+}
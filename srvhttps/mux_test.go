@@ -0,0 +1,61 @@
+package srvhttps
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchPrecedence(test *testing.T) {
+	mux := NewHolaMux()
+	patterns := []string{
+		"example.com/",
+		"example.com/exact",
+		"api.example.com/",
+		"*.example.com/",
+		"*.example.com/static/",
+		"*.api.example.com/",
+		"*.other.com/page",
+	}
+	for _, pattern := range patterns {
+		err := mux.MountFunc(
+			pattern, "owner", MountOptions{},
+			func(http.ResponseWriter, *http.Request) {})
+		if err != nil {
+			test.Fatal("could not mount", pattern, err)
+		}
+	}
+
+	cases := []struct {
+		name    string
+		host    string
+		path    string
+		pattern string
+	}{
+		{"exact path", "example.com", "/exact", "example.com/exact"},
+		{"exact host prefix", "example.com", "/other", "example.com/"},
+		{"exact host before wildcard",
+			"api.example.com", "/static/a", "api.example.com/"},
+		{"wildcard", "www.example.com", "/", "*.example.com/"},
+		{"longer wildcard path",
+			"www.example.com", "/static/a", "*.example.com/static/"},
+		{"longest suffix wins",
+			"v1.api.example.com", "/static/a", "*.api.example.com/"},
+		{"deep subdomain", "a.b.example.com", "/", "*.example.com/"},
+		{"wildcard needs a label", "example.com", "/", "example.com/"},
+		{"suffix is not a label", "badexample.com", "/", ""},
+		{"bare domain against wildcard", "other.com", "/page", ""},
+		{"wildcard exact path", "www.other.com", "/page", "*.other.com/page"},
+		{"wildcard exact path only",
+			"www.other.com", "/page/more", ""},
+	}
+
+	for _, testCase := range cases {
+		_, pattern := mux.match(testCase.host, testCase.path)
+		if pattern != testCase.pattern {
+			test.Errorf(
+				"%s: %s%s matched %q, expected %q",
+				testCase.name, testCase.host, testCase.path,
+				pattern, testCase.pattern)
+		}
+	}
+}
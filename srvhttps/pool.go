@@ -0,0 +1,451 @@
+package srvhttps
+
+import (
+	"errors"
+	"github.com/hlhv/hlhv-queen/conf"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+/* MountOptions holds optional information a cell can give about a mount.
+ */
+type MountOptions struct {
+	// Version is the version of the cell, used to split traffic between
+	// versions of a cell mounted on the same pattern.
+	Version string
+	// Weight is the share of traffic the version should receive, relative
+	// to other versions. It can be overridden in the config file.
+	Weight int
+	// Affinity is how requests from the same client are kept on the same
+	// cell, and AffinityName is the cookie or header it looks at. They can
+	// be overridden in the config file.
+	Affinity     string
+	AffinityName string
+}
+
+/* pool is a group of handlers mounted on the same pattern. Each request is
+ * first given to a version, chosen by weight, and then to one member of that
+ * version, chosen using the balancing strategy configured for the pattern.
+ */
+type pool struct {
+	pattern  string
+	mutex    sync.RWMutex
+	members  []*poolMember
+	versions map[string]*versionStats
+	next     uint64
+}
+
+/* poolMember is a single handler in a pool, owned by a single cell.
+ */
+type poolMember struct {
+	owner       string
+	handler     http.Handler
+	options     MountOptions
+	outstanding int64
+
+	// token identifies the member in affinity cookies
+	token string
+}
+
+/* versionStats counts requests handled by a single version in a pool. A
+ * request counts as an error if the response has a 5xx status code.
+ */
+type versionStats struct {
+	requests uint64
+	errors   uint64
+}
+
+/* statusWriter records the status code of a response. Informational responses
+ * such as 103 Early Hints may come before the final one, so they are not
+ * recorded.
+ */
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (writer *statusWriter) WriteHeader(status int) {
+	if writer.status == 0 && status >= 200 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *statusWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+/* Unwrap returns the underlying ResponseWriter.
+ */
+func (writer *statusWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+/* newPool creates an empty pool for a pattern.
+ */
+func newPool(pattern string) *pool {
+	return &pool{
+		pattern:  pattern,
+		versions: make(map[string]*versionStats),
+	}
+}
+
+/* add adds a handler to the pool. An owner may only have one handler in each
+ * pool.
+ */
+func (pool *pool) add(
+	owner string,
+	options MountOptions,
+	handler http.Handler,
+) (
+	err error,
+) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, member := range pool.members {
+		if member.owner == owner {
+			return errors.New(
+				"mux: existing mount on " + pool.pattern +
+					" by the same owner")
+		}
+	}
+
+	if options.Weight < 0 {
+		return errors.New("mux: weight cannot be negative")
+	}
+
+	err = conf.CheckAffinity(options.Affinity, options.AffinityName)
+	if err != nil {
+		return errors.New("mux: " + err.Error())
+	}
+
+	token, err := newAffinityToken()
+	if err != nil {
+		return err
+	}
+
+	pool.members = append(pool.members, &poolMember{
+		owner:   owner,
+		handler: handler,
+		options: options,
+		token:   token,
+	})
+
+	if _, exists := pool.versions[options.Version]; !exists {
+		pool.versions[options.Version] = &versionStats{}
+	}
+	return nil
+}
+
+/* remove removes an owner's handler from the pool, and returns how many
+ * members are left.
+ */
+func (pool *pool) remove(owner string) (remaining int, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for index, member := range pool.members {
+		if member.owner != owner {
+			continue
+		}
+		pool.members = append(
+			pool.members[:index],
+			pool.members[index+1:]...)
+		return len(pool.members), nil
+	}
+
+	return len(pool.members), errors.New(
+		"mux: pattern " + pool.pattern + " is not mounted by " + owner)
+}
+
+/* size returns the number of members in the pool.
+ */
+func (pool *pool) size() int {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	return len(pool.members)
+}
+
+/* ServeHTTP hands the request to a member of the pool.
+ */
+func (pool *pool) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	member, stats, cookie := pool.choose(req)
+	if member == nil {
+		WriteServUnavail(res, req, errors.New(
+			"no cells are mounted on "+pool.pattern))
+		return
+	}
+
+	if cookie != nil {
+		http.SetCookie(res, cookie)
+	}
+
+	atomic.AddInt64(&member.outstanding, 1)
+	defer atomic.AddInt64(&member.outstanding, -1)
+
+	writer := &statusWriter{ResponseWriter: res}
+	member.handler.ServeHTTP(writer, req)
+
+	atomic.AddUint64(&stats.requests, 1)
+	if writer.status >= 500 {
+		atomic.AddUint64(&stats.errors, 1)
+	}
+}
+
+/* choose picks a member of the pool. If the request is pinned to a version,
+ * only members of that version are considered. If the request has affinity to
+ * a member that is still in the pool, that member is chosen. Otherwise, a
+ * version is chosen by weight, and then a member of the version is chosen
+ * according to the balancing strategy configured for the pattern. It returns
+ * nil if the pool is empty. If the client should be given an affinity cookie,
+ * it is returned as well.
+ */
+func (pool *pool) choose(
+	req *http.Request,
+) (
+	chosen *poolMember,
+	stats *versionStats,
+	cookie *http.Cookie,
+) {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	if len(pool.members) == 0 {
+		return nil, nil, nil
+	}
+
+	version, pinned := pool.pinnedVersion(req)
+	affinity, affinityName := pool.affinity()
+
+	switch affinity {
+	case conf.AffinityCookie:
+		chosen = pool.memberByCookie(req, affinityName)
+		if chosen != nil &&
+			(!pinned || chosen.options.Version == version) {
+			return chosen, pool.versions[chosen.options.Version], nil
+		}
+
+		if !pinned {
+			version = pool.chooseVersion(rand.Intn)
+		}
+		chosen = pool.balance(pool.candidates(version))
+		cookie = pool.affinityCookie(affinityName, chosen)
+		return chosen, pool.versions[chosen.options.Version], cookie
+
+	case conf.AffinityCookieHash, conf.AffinityHeader, conf.AffinityIp:
+		key := affinityKey(req, affinity, affinityName)
+		if key == "" {
+			break
+		}
+
+		hash := hashString(key)
+		if !pinned {
+			version = pool.chooseVersion(func(total int) int {
+				return int(hash % uint64(total))
+			})
+		}
+		chosen = rendezvous(pool.candidates(version), key)
+		return chosen, pool.versions[chosen.options.Version], nil
+	}
+
+	if !pinned {
+		version = pool.chooseVersion(rand.Intn)
+	}
+	chosen = pool.balance(pool.candidates(version))
+	return chosen, pool.versions[chosen.options.Version], nil
+}
+
+/* candidates returns every member of the pool with the given version.
+ */
+func (pool *pool) candidates(version string) (candidates []*poolMember) {
+	candidates = make([]*poolMember, 0, len(pool.members))
+	for _, member := range pool.members {
+		if member.options.Version == version {
+			candidates = append(candidates, member)
+		}
+	}
+	return candidates
+}
+
+/* pinnedVersion returns the version a request asks for through the cookie or
+ * header configured for the pattern, if that version is mounted.
+ */
+func (pool *pool) pinnedVersion(req *http.Request) (version string, pinned bool) {
+	source, name := conf.GetVersionPin(pool.pattern)
+	switch source {
+	case conf.PinCookie:
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return "", false
+		}
+		version = cookie.Value
+	case conf.PinHeader:
+		version = req.Header.Get(name)
+	default:
+		return "", false
+	}
+
+	// a missing or empty pin does not pin the request to the cells that
+	// have no version
+	if version == "" {
+		return "", false
+	}
+
+	for _, member := range pool.members {
+		if member.options.Version == version {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+/* weights returns the weight of every version that has members in the pool.
+ * Weights set in the config file take precedence over the ones given by cells.
+ * If several members of a version give different weights, the largest one is
+ * used.
+ */
+func (pool *pool) weights() (weights map[string]int) {
+	weights = make(map[string]int)
+	for _, member := range pool.members {
+		version := member.options.Version
+		if member.options.Weight > weights[version] {
+			weights[version] = member.options.Weight
+		} else if _, exists := weights[version]; !exists {
+			weights[version] = 0
+		}
+	}
+
+	for version := range weights {
+		weight, overridden := conf.GetVersionWeight(pool.pattern, version)
+		if overridden {
+			weights[version] = weight
+		}
+	}
+
+	return weights
+}
+
+/* chooseVersion picks a version in proportion to its weight, using pick to
+ * choose a point between 0 and the total weight. If only one version is
+ * mounted, it is always chosen. If no version has any weight, they are all
+ * treated equally.
+ */
+func (pool *pool) chooseVersion(pick func(total int) int) (version string) {
+	weights := pool.weights()
+	if len(weights) == 1 {
+		for version = range weights {
+			return version
+		}
+	}
+
+	// sort so that the same weights always divide traffic the same way
+	versions := make([]string, 0, len(weights))
+	total := 0
+	for version, weight := range weights {
+		versions = append(versions, version)
+		total += weight
+	}
+	sort.Strings(versions)
+
+	if total == 0 {
+		return versions[pick(len(versions))]
+	}
+
+	point := pick(total)
+	for _, version = range versions {
+		point -= weights[version]
+		if point < 0 {
+			return version
+		}
+	}
+	return versions[len(versions)-1]
+}
+
+/* balance picks one of the candidates according to the balancing strategy
+ * configured for the pattern.
+ */
+func (pool *pool) balance(candidates []*poolMember) (chosen *poolMember) {
+	count := len(candidates)
+	if count == 1 {
+		return candidates[0]
+	}
+
+	switch conf.GetBalanceStrategy(pool.pattern) {
+	case conf.BalanceLeastRequests:
+		// start at a rotating offset, so that ties are spread out
+		// instead of always going to the first member
+		start := int(atomic.AddUint64(&pool.next, 1) % uint64(count))
+		for offset := 0; offset < count; offset++ {
+			member := candidates[(start+offset)%count]
+			if chosen == nil ||
+				atomic.LoadInt64(&member.outstanding) <
+					atomic.LoadInt64(&chosen.outstanding) {
+				chosen = member
+			}
+		}
+		return chosen
+
+	case conf.BalanceRandomTwo:
+		first := rand.Intn(count)
+		second := rand.Intn(count - 1)
+		if second >= first {
+			second++
+		}
+		chosen = candidates[first]
+		other := candidates[second]
+		if atomic.LoadInt64(&other.outstanding) <
+			atomic.LoadInt64(&chosen.outstanding) {
+			chosen = other
+		}
+		return chosen
+
+	default:
+		index := atomic.AddUint64(&pool.next, 1) % uint64(count)
+		return candidates[index]
+	}
+}
+
+/* stats describes the pool, and how many requests and errors each version in
+ * it has handled since the pattern was first mounted.
+ */
+func (pool *pool) stats() (lines []string) {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	weights := pool.weights()
+	members := make(map[string]int)
+	for _, member := range pool.members {
+		members[member.options.Version]++
+	}
+
+	versions := make([]string, 0, len(pool.versions))
+	for version := range pool.versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+
+	for _, version := range versions {
+		stats := pool.versions[version]
+		name := version
+		if name == "" {
+			name = "(none)"
+		}
+		lines = append(lines, pool.pattern+
+			" version "+name+
+			" cells "+strconv.Itoa(members[version])+
+			" weight "+strconv.Itoa(weights[version])+
+			" requests "+strconv.FormatUint(
+			atomic.LoadUint64(&stats.requests), 10)+
+			" errors "+strconv.FormatUint(
+			atomic.LoadUint64(&stats.errors), 10))
+	}
+	return lines
+}
@@ -0,0 +1,113 @@
+package srvhttps
+
+import (
+	"github.com/hlhv/hlhv-queen/conf"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStatsIgnoreInformational(test *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		errors   uint64
+	}{
+		{"ok", []int{http.StatusOK}, 0},
+		{"bad gateway", []int{http.StatusBadGateway}, 1},
+		{"early hints then ok",
+			[]int{http.StatusEarlyHints, http.StatusOK}, 0},
+		{"early hints then bad gateway",
+			[]int{http.StatusEarlyHints, http.StatusBadGateway}, 1},
+	}
+
+	for _, testCase := range cases {
+		statuses := testCase.statuses
+		pool := newPool("example.com/")
+		err := pool.add(
+			"owner", MountOptions{},
+			http.HandlerFunc(func(
+				res http.ResponseWriter,
+				req *http.Request,
+			) {
+				for _, status := range statuses {
+					res.WriteHeader(status)
+				}
+			}))
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		pool.ServeHTTP(
+			httptest.NewRecorder(),
+			httptest.NewRequest("GET", "https://example.com/", nil))
+
+		stats := pool.versions[""]
+		if atomic.LoadUint64(&stats.requests) != 1 {
+			test.Errorf("%s: request was not counted", testCase.name)
+		}
+		if atomic.LoadUint64(&stats.errors) != testCase.errors {
+			test.Errorf(
+				"%s: counted %d errors, expected %d",
+				testCase.name,
+				atomic.LoadUint64(&stats.errors),
+				testCase.errors)
+		}
+	}
+}
+
+func TestPinnedVersionMissing(test *testing.T) {
+	confPath := test.TempDir() + "/hlhv.conf"
+	err := os.WriteFile(
+		confPath,
+		[]byte("pinVersion example.com/ header X-Version\n"),
+		0600)
+	if err != nil {
+		test.Fatal(err)
+	}
+	err = conf.Load(confPath)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	pool := newPool("example.com/")
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	err = pool.add("stable", MountOptions{Weight: 9}, handler)
+	if err != nil {
+		test.Fatal(err)
+	}
+	err = pool.add(
+		"canary", MountOptions{Version: "canary", Weight: 1}, handler)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		sent    bool
+		header  string
+		version string
+		pinned  bool
+	}{
+		{"missing", false, "", "", false},
+		{"empty", true, "", "", false},
+		{"canary", true, "canary", "canary", true},
+		{"unknown", true, "nope", "", false},
+	}
+
+	for _, testCase := range cases {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		if testCase.sent {
+			req.Header.Set("X-Version", testCase.header)
+		}
+		version, pinned := pool.pinnedVersion(req)
+		if version != testCase.version || pinned != testCase.pinned {
+			test.Errorf(
+				"%s: pinned to %q %v, expected %q %v",
+				testCase.name, version, pinned,
+				testCase.version, testCase.pinned)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package srvhttps
+
+import (
+	"net"
+	"sync"
+)
+
+/* relay owns the real listening socket, and hands accepted connections out to
+ * whichever http.Server is currently being used. This allows the server to be
+ * swapped out (for example, to apply new timeouts) without ever closing the
+ * port.
+ */
+type relay struct {
+	underlying net.Listener
+	conns      chan net.Conn
+	closed     chan struct{}
+	stopped    chan struct{}
+	stopOnce   sync.Once
+	err        error
+}
+
+/* handoff is a net.Listener view into a relay. Closing it only detaches it from
+ * the relay, and leaves the real socket open.
+ */
+type handoff struct {
+	relay     *relay
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+/* newRelay starts accepting connections from a listener, and returns a relay
+ * that distributes them.
+ */
+func newRelay(underlying net.Listener) (result *relay) {
+	result = &relay{
+		underlying: underlying,
+		conns:      make(chan net.Conn),
+		closed:     make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go result.acceptLoop()
+	return result
+}
+
+/* acceptLoop accepts connections until the underlying listener is closed.
+ * Connections that have been accepted but not yet picked up by a handoff stay
+ * here until one is available, so none are lost while servers are swapped.
+ */
+func (relay *relay) acceptLoop() {
+	defer close(relay.closed)
+	for {
+		conn, err := relay.underlying.Accept()
+		if err != nil {
+			relay.err = err
+			return
+		}
+
+		select {
+		case relay.conns <- conn:
+		case <-relay.stopped:
+			conn.Close()
+			relay.err = net.ErrClosed
+			return
+		}
+	}
+}
+
+/* handoff creates a new listener view into the relay.
+ */
+func (relay *relay) handoff() (view *handoff) {
+	return &handoff{
+		relay: relay,
+		done:  make(chan struct{}),
+	}
+}
+
+/* Close closes the real listening socket.
+ */
+func (relay *relay) Close() error {
+	relay.stopOnce.Do(func() { close(relay.stopped) })
+	return relay.underlying.Close()
+}
+
+func (view *handoff) Accept() (net.Conn, error) {
+	select {
+	case conn := <-view.relay.conns:
+		return conn, nil
+	case <-view.done:
+		return nil, net.ErrClosed
+	case <-view.relay.closed:
+		return nil, view.relay.err
+	}
+}
+
+func (view *handoff) Close() error {
+	view.closeOnce.Do(func() { close(view.done) })
+	return nil
+}
+
+func (view *handoff) Addr() net.Addr {
+	return view.relay.underlying.Addr()
+}
@@ -1,30 +1,42 @@
 package srvhttps
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/hlhv/hlhv-queen/conf"
 	"github.com/hlhv/scribe"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
 var mux *HolaMux
 var server *http.Server
+var serverMutex sync.Mutex
+var listener *relay
 var port string
 var stopNotify chan int
 var listening bool
 
 func Arm() (err error) {
 	port = strconv.Itoa(conf.GetPortHttps())
-	timeoutReadHeader := time.Duration(conf.GetTimeoutReadHeader())
-	timeoutRead := time.Duration(conf.GetTimeoutRead())
-	timeoutWrite := time.Duration(conf.GetTimeoutWrite())
-	timeoutIdle := time.Duration(conf.GetTimeoutIdle())
 	scribe.PrintProgress(
 		scribe.LogLevelNormal,
 		"arming https server on port", port)
 	mux = NewHolaMux()
+	server = newServer()
+	return nil
+}
+
+/* newServer creates an http server using the current configuration.
+ */
+func newServer() *http.Server {
+	timeoutReadHeader := time.Duration(conf.GetTimeoutReadHeader())
+	timeoutRead := time.Duration(conf.GetTimeoutRead())
+	timeoutWrite := time.Duration(conf.GetTimeoutWrite())
+	timeoutIdle := time.Duration(conf.GetTimeoutIdle())
 
 	// following:
 	// https://blog.cloudflare.com/exposing-go-on-the-internet/
@@ -45,7 +57,7 @@ func Arm() (err error) {
 		},
 	}
 
-	server = &http.Server{
+	return &http.Server{
 		Addr:              ":" + port,
 		ReadHeaderTimeout: timeoutReadHeader * time.Second,
 		ReadTimeout:       timeoutRead * time.Second,
@@ -54,7 +66,6 @@ func Arm() (err error) {
 		TLSConfig:         serverConf,
 		Handler:           mux,
 	}
-	return nil
 }
 
 func Fire() {
@@ -69,9 +80,32 @@ func Fire() {
 			"srvhttps no longer listening")
 	}()
 
-	keyPath := conf.GetKeyPath()
-	certPath := conf.GetCertPath()
-	exitMsg := server.ListenAndServeTLS(certPath, keyPath)
+	underlying, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		scribe.PrintFatal(scribe.LogLevelError, err.Error())
+		return
+	}
+	listener = newRelay(underlying)
+
+	var exitMsg error
+	for {
+		serverMutex.Lock()
+		current := server
+		serverMutex.Unlock()
+
+		keyPath := conf.GetKeyPath()
+		certPath := conf.GetCertPath()
+		exitMsg = current.ServeTLS(listener.handoff(), certPath, keyPath)
+
+		// if the server was swapped out by a reload, serve using the
+		// new one
+		serverMutex.Lock()
+		replaced := server != current
+		serverMutex.Unlock()
+		if !replaced || stopNotify != nil {
+			break
+		}
+	}
 
 	if stopNotify == nil {
 		scribe.PrintFatal(scribe.LogLevelError, exitMsg.Error())
@@ -80,6 +114,43 @@ func Fire() {
 	}
 }
 
+/* Reload replaces the running http server with a new one using the current
+ * configuration, without closing the listening port. Requests that are already
+ * in progress are allowed to finish on the old server. Streamed responses may
+ * take much longer than the write timeout, so they are given the drain timeout
+ * instead, and only what is still running after that is cut off.
+ */
+func Reload() {
+	if !listening {
+		return
+	}
+
+	if strconv.Itoa(conf.GetPortHttps()) != port {
+		scribe.PrintWarning(
+			scribe.LogLevelError,
+			"portHttps has changed, restart to apply it")
+	}
+
+	scribe.PrintProgress(scribe.LogLevelNormal, "reloading https server")
+	serverMutex.Lock()
+	previous := server
+	server = newServer()
+	serverMutex.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Duration(conf.GetTimeoutDrain())*time.Second)
+		defer cancel()
+
+		err := previous.Shutdown(ctx)
+		if err != nil {
+			previous.Close()
+		}
+	}()
+	scribe.PrintDone(scribe.LogLevelNormal, "reloaded https server")
+}
+
 func Close() {
 	if !listening {
 		return
@@ -87,20 +158,38 @@ func Close() {
 
 	scribe.PrintProgress(scribe.LogLevelNormal, "stopping https server")
 	stopNotify = make(chan int)
+	serverMutex.Lock()
 	server.Close()
+	serverMutex.Unlock()
+	listener.Close()
 	<-stopNotify
 	scribe.PrintDone(scribe.LogLevelNormal, "stopped https server")
 }
 
+/* GetPort returns the port the https server is listening on.
+ */
+func GetPort() string {
+	return port
+}
+
 func MountFunc(
 	pattern string,
+	owner string,
+	options MountOptions,
 	handler func(http.ResponseWriter, *http.Request),
 ) (
 	err error,
 ) {
-	return mux.MountFunc(pattern, handler)
+	return mux.MountFunc(pattern, owner, options, handler)
+}
+
+func Unmount(pattern string, owner string) (err error) {
+	return mux.Unmount(pattern, owner)
 }
 
-func Unmount(pattern string) (err error) {
-	return mux.Unmount(pattern)
+/* Stats describes every mounted pattern, and how many requests and errors each
+ * version of the cells mounted on it has handled.
+ */
+func Stats() (lines []string) {
+	return mux.Stats()
 }
@@ -0,0 +1,131 @@
+package wrangler
+
+import (
+	"github.com/hlhv/hlhv-queen/conf"
+	"github.com/hlhv/scribe"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+/* handshakes keeps track of connections that have been accepted, but have not
+ * yet logged in as a cell or a band. Each one is handled in its own goroutine,
+ * but only a limited number of them are allowed to do work at once, and the
+ * rest wait for a turn. This way, a client that never sends anything only holds
+ * up its own connection, and not every other one behind it.
+ */
+var handshakes struct {
+	inFlight int
+	running  int
+	perIp    map[string]int
+	mutex    sync.Mutex
+	turn     *sync.Cond
+
+	// rejected counts connections turned away for going over a limit
+	rejected uint64
+}
+
+func init() {
+	handshakes.perIp = make(map[string]int)
+	handshakes.turn = sync.NewCond(&handshakes.mutex)
+}
+
+/* Stats describes how many connections are logging in, and how many have been
+ * turned away.
+ */
+func Stats() (lines []string) {
+	handshakes.mutex.Lock()
+	inFlight := handshakes.inFlight
+	handshakes.mutex.Unlock()
+
+	return []string{
+		"handshakes in flight " + strconv.Itoa(inFlight),
+		"handshakes rejected " + strconv.FormatUint(
+			atomic.LoadUint64(&handshakes.rejected), 10),
+	}
+}
+
+/* handshake logs a newly accepted connection in, without blocking the accept
+ * loop. If there are already too many connections logging in, either in total
+ * or from the same address, the connection is closed straight away.
+ */
+func handshake(conn net.Conn) {
+	ip := remoteIp(conn)
+	if !admitHandshake(ip) {
+		atomic.AddUint64(&handshakes.rejected, 1)
+		conn.Close()
+		scribe.PrintDisconnect(
+			scribe.LogLevelNormal,
+			"kicked", ip, "for having too many connections logging in")
+		return
+	}
+
+	go func() {
+		defer finishHandshake(ip)
+		waitHandshakeTurn()
+
+		err := handleConn(conn)
+		if err != nil {
+			scribe.PrintError(
+				scribe.LogLevelError,
+				"wrangler accept:", err)
+		}
+	}()
+}
+
+/* admitHandshake counts a new connection from an address as logging in, unless
+ * that would go over one of the configured limits.
+ */
+func admitHandshake(ip string) (admitted bool) {
+	handshakes.mutex.Lock()
+	defer handshakes.mutex.Unlock()
+
+	if handshakes.inFlight >= conf.GetMaxHandshakes() ||
+		handshakes.perIp[ip] >= conf.GetMaxHandshakesPerIp() {
+		return false
+	}
+
+	handshakes.inFlight++
+	handshakes.perIp[ip]++
+	return true
+}
+
+/* waitHandshakeTurn waits until fewer than the configured number of handshakes
+ * are being worked on, and then takes up a spot.
+ */
+func waitHandshakeTurn() {
+	handshakes.mutex.Lock()
+	defer handshakes.mutex.Unlock()
+
+	for handshakes.running >= conf.GetHandshakeWorkers() {
+		handshakes.turn.Wait()
+	}
+	handshakes.running++
+}
+
+/* finishHandshake stops counting a connection as logging in, and lets the next
+ * one have its turn.
+ */
+func finishHandshake(ip string) {
+	handshakes.mutex.Lock()
+	defer handshakes.mutex.Unlock()
+
+	handshakes.running--
+	handshakes.inFlight--
+	handshakes.perIp[ip]--
+	if handshakes.perIp[ip] <= 0 {
+		delete(handshakes.perIp, ip)
+	}
+	handshakes.turn.Broadcast()
+}
+
+/* remoteIp returns the address a connection came from, without the port.
+ */
+func remoteIp(conn net.Conn) (ip string) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return ip
+}
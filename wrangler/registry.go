@@ -0,0 +1,158 @@
+package wrangler
+
+import (
+	"github.com/hlhv/hlhv-queen/cells"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* registry keeps track of every cell that is connected to the queen. Cells log
+ * in, bind bands, and disconnect from many goroutines at once, so every access
+ * goes through its mutex. Cells are indexed by uuid and by name. Lookups by
+ * mount pattern go through every cell, because cells mount and unmount patterns
+ * on their own.
+ */
+type registry struct {
+	byUuid map[string]*cells.Cell
+	byName map[string]map[string]*cells.Cell
+	mutex  sync.RWMutex
+}
+
+/* newRegistry creates an empty registry.
+ */
+func newRegistry() (result *registry) {
+	return &registry{
+		byUuid: make(map[string]*cells.Cell),
+		byName: make(map[string]map[string]*cells.Cell),
+	}
+}
+
+/* add adds a cell to the registry. It returns false, and leaves the registry
+ * alone, if a cell with the same uuid is already in it.
+ */
+func (registry *registry) add(cell *cells.Cell) (added bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	uuid := cell.Uuid()
+	if _, exists := registry.byUuid[uuid]; exists {
+		return false
+	}
+	registry.byUuid[uuid] = cell
+
+	named, exists := registry.byName[cell.Name()]
+	if !exists {
+		named = make(map[string]*cells.Cell)
+		registry.byName[cell.Name()] = named
+	}
+	named[uuid] = cell
+	return true
+}
+
+/* remove removes a cell from the registry, if it is in it.
+ */
+func (registry *registry) remove(cell *cells.Cell) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	uuid := cell.Uuid()
+	if registry.byUuid[uuid] != cell {
+		return
+	}
+	delete(registry.byUuid, uuid)
+
+	named := registry.byName[cell.Name()]
+	delete(named, uuid)
+	if len(named) == 0 {
+		delete(registry.byName, cell.Name())
+	}
+}
+
+/* lookup returns the cell with the given uuid, or nil if there is none.
+ */
+func (registry *registry) lookup(uuid string) (cell *cells.Cell) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.byUuid[uuid]
+}
+
+/* lookupName returns every cell that logged in with the given name.
+ */
+func (registry *registry) lookupName(name string) (found []*cells.Cell) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	for _, cell := range registry.byName[name] {
+		found = append(found, cell)
+	}
+	return found
+}
+
+/* lookupPattern returns every cell that is mounted on the given pattern.
+ */
+func (registry *registry) lookupPattern(pattern string) (found []*cells.Cell) {
+	for _, cell := range registry.snapshot() {
+		for _, mounted := range cell.Mounts() {
+			if mounted == pattern {
+				found = append(found, cell)
+				break
+			}
+		}
+	}
+	return found
+}
+
+/* snapshot returns every cell in the registry at the time it is called. The
+ * registry is not locked while the caller goes through the list, so cells may
+ * be added or removed in the meantime.
+ */
+func (registry *registry) snapshot() (all []*cells.Cell) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	all = make([]*cells.Cell, 0, len(registry.byUuid))
+	for _, cell := range registry.byUuid {
+		all = append(all, cell)
+	}
+	return all
+}
+
+/* ListCells describes every connected cell, one per line. If a filter is
+ * given, only cells with that name or mounted on that pattern are listed.
+ */
+func ListCells(filter string) (lines []string) {
+	var found []*cells.Cell
+	if filter == "" {
+		found = cellStore.snapshot()
+	} else {
+		found = append(
+			cellStore.lookupName(filter),
+			cellStore.lookupPattern(filter)...)
+	}
+
+	seen := make(map[*cells.Cell]bool)
+	for _, cell := range found {
+		if seen[cell] {
+			continue
+		}
+		seen[cell] = true
+
+		name := cell.Name()
+		if name == "" {
+			name = "(none)"
+		}
+		identity := cell.Identity()
+		if identity == "" {
+			identity = "(connKey)"
+		}
+		mounts := cell.Mounts()
+		sort.Strings(mounts)
+		lines = append(lines, cell.Uuid()+
+			" name "+name+
+			" identity "+identity+
+			" mounts "+strings.Join(mounts, " "))
+	}
+	sort.Strings(lines)
+	return lines
+}
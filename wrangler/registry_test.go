@@ -0,0 +1,141 @@
+package wrangler
+
+import (
+	"fmt"
+	"github.com/hlhv/fsock"
+	"github.com/hlhv/hlhv-queen/cells"
+	"github.com/hlhv/hlhv-queen/conf"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+/* pipe returns one end of an in-memory connection, with everything written to
+ * it thrown away on the other end.
+ */
+func pipe(test *testing.T) (conn net.Conn) {
+	conn, other := net.Pipe()
+	test.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	go io.Copy(io.Discard, other)
+	return conn
+}
+
+func newTestCell(test *testing.T, index int) (cell *cells.Cell) {
+	leash := pipe(test)
+	cell = cells.NewCell(
+		leash,
+		fsock.NewReader(leash),
+		fsock.NewWriter(leash),
+		fmt.Sprint("uuid-", index),
+		fmt.Sprint("name-", index%3),
+		"", "", nil,
+		cleanUpCell)
+	go cell.ListenSig()
+	return cell
+}
+
+/* TestRegistryConcurrent binds, looks up, uses, and disconnects cells from many
+ * goroutines at once. It is meant to be run with -race.
+ */
+func TestRegistryConcurrent(test *testing.T) {
+	conf.Load(test.TempDir() + "/none.conf")
+	cellStore = newRegistry()
+
+	const cellCount = 8
+	const bandCount = 4
+
+	group := sync.WaitGroup{}
+	for index := 0; index < cellCount; index++ {
+		cell := newTestCell(test, index)
+		if !cellStore.add(cell) {
+			test.Fatal("could not add cell", index)
+		}
+		if cellStore.add(cell) {
+			test.Fatal("added cell", index, "twice")
+		}
+
+		// bind bands
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for band := 0; band < bandCount; band++ {
+				conn := pipe(test)
+				err := handleConnBand(
+					conn,
+					fsock.NewReader(conn),
+					fsock.NewWriter(conn),
+					cell.Uuid(), cell.Key(), "")
+				if err != nil {
+					test.Error("could not bind band:", err)
+				}
+			}
+		}()
+
+		// use bands, and sometimes close them
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for round := 0; round < bandCount*2; round++ {
+				band, err := cell.Provide()
+				if err != nil {
+					continue
+				}
+				if round%3 == 0 {
+					band.Close()
+				}
+				cell.Release(band)
+			}
+		}()
+
+		// prune
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for round := 0; round < bandCount*2; round++ {
+				cell.Prune()
+			}
+		}()
+	}
+
+	// look cells up
+	for index := 0; index < cellCount; index++ {
+		group.Add(1)
+		go func(index int) {
+			defer group.Done()
+			if cellStore.lookup(fmt.Sprint("uuid-", index)) == nil {
+				test.Error("could not look up cell", index)
+			}
+			cellStore.lookupName(fmt.Sprint("name-", index%3))
+			cellStore.lookupPattern("@/")
+			ListCells("")
+		}(index)
+	}
+	group.Wait()
+
+	if len(cellStore.lookupName("name-0")) != 3 {
+		test.Fatal("expected three cells named name-0")
+	}
+
+	// disconnect every cell while it is still being looked up
+	for _, cell := range cellStore.snapshot() {
+		group.Add(2)
+		go func(cell *cells.Cell) {
+			defer group.Done()
+			cleanUpCell(cell)
+		}(cell)
+		go func(uuid string) {
+			defer group.Done()
+			cellStore.lookup(uuid)
+			cellStore.snapshot()
+		}(cell.Uuid())
+	}
+	group.Wait()
+
+	if len(cellStore.snapshot()) != 0 {
+		test.Fatal("cells left over after disconnecting every one")
+	}
+}
@@ -2,6 +2,7 @@ package wrangler
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,16 +20,21 @@ import (
 )
 
 var port string
-var cert tls.Certificate
+var cert struct {
+	current *tls.Certificate
+	mutex   sync.RWMutex
+
+	// clientAuth and clientCas decide whether cells must present a
+	// certificate, and what it must be signed by
+	clientAuth tls.ClientAuthType
+	clientCas  *x509.CertPool
+}
 var config tls.Config
 var listening bool
 var stopNotify chan int
 var server net.Listener
 
-var cellStore struct {
-	lookup map[string]*cells.Cell
-	mutex  sync.Mutex
-}
+var cellStore *registry
 
 /* Arm initializes the cell wrangler, loading the certificate and initializing
  * maps.
@@ -39,24 +45,138 @@ func Arm() (err error) {
 		scribe.LogLevelNormal,
 		"arming cell wrangler on port", port)
 
+	err = loadCert()
+	if err != nil {
+		return err
+	}
+
+	config = tls.Config{GetConfigForClient: getConfig}
+
+	cellStore = newRegistry()
+
+	return nil
+}
+
+/* Reload applies changes in the configuration to the cell wrangler. Timeouts
+ * and gardening settings are read from conf each time they are used, and the
+ * certificate is re-loaded for new connections. Connected cells and their bands
+ * are left untouched, unless the key a cell logged in with has been revoked, or
+ * it is no longer allowed to mount a pattern.
+ */
+func Reload() {
+	if strconv.Itoa(conf.GetPortHlhv()) != port {
+		scribe.PrintWarning(
+			scribe.LogLevelError,
+			"portHlhv has changed, restart to apply it")
+	}
+
+	err := loadCert()
+	if err != nil {
+		scribe.PrintWarning(
+			scribe.LogLevelError,
+			"keeping old certificate: "+err.Error())
+	}
+
+	applyCredentials()
+}
+
+/* applyCredentials disconnects every cell whose key has been changed or removed
+ * from the configuration, and takes away mounts that other cells are no longer
+ * allowed to have.
+ */
+func applyCredentials() {
+	for _, cell := range cellStore.snapshot() {
+		if conf.CheckCredential(cell.Identity(), cell.Credential()) {
+			cell.EnforceMountPolicy()
+			continue
+		}
+		scribe.PrintDisconnect(
+			scribe.LogLevelNormal,
+			"kicking cell", cell.Uuid(),
+			"because its credentials were revoked")
+		cell.Kick()
+	}
+}
+
+/* loadCert loads the certificate specified in conf, and makes it the one
+ * presented to new connections. If client certificates are turned on, the CA
+ * bundle they are checked against is loaded as well.
+ */
+func loadCert() (err error) {
 	keyPath := conf.GetKeyPath()
 	certPath := conf.GetCertPath()
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	loaded, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err != nil {
 		return errors.New(
 			"certificate is not present or inaccessible")
 	}
 
-	config = tls.Config{Certificates: []tls.Certificate{cert}}
-
-	cellStore.lookup = make(map[string]*cells.Cell)
+	clientAuth := tls.NoClientCert
+	var clientCas *x509.CertPool
+	switch conf.GetClientCert() {
+	case conf.ClientCertOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case conf.ClientCertRequired:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	if clientAuth != tls.NoClientCert {
+		clientCas, err = loadClientCas()
+		if err != nil {
+			return err
+		}
+	}
 
+	cert.mutex.Lock()
+	cert.current = &loaded
+	cert.clientAuth = clientAuth
+	cert.clientCas = clientCas
+	cert.mutex.Unlock()
 	return nil
 }
 
+/* loadClientCas loads the CA bundle specified in conf, which client
+ * certificates are checked against.
+ */
+func loadClientCas() (clientCas *x509.CertPool, err error) {
+	bundle, err := os.ReadFile(conf.GetClientCaPath())
+	if err != nil {
+		return nil, errors.New(
+			"client CA bundle is not present or inaccessible")
+	}
+
+	clientCas = x509.NewCertPool()
+	if !clientCas.AppendCertsFromPEM(bundle) {
+		return nil, errors.New(
+			"client CA bundle does not contain any certificates")
+	}
+	return clientCas, nil
+}
+
+/* getConfig returns the tls configuration used for a new connection, so that
+ * it always reflects the latest certificate and client certificate settings.
+ */
+func getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cert.mutex.RLock()
+	defer cert.mutex.RUnlock()
+	return &tls.Config{
+		GetCertificate: getCert,
+		ClientAuth:     cert.clientAuth,
+		ClientCAs:      cert.clientCas,
+	}, nil
+}
+
+/* getCert returns the certificate currently presented to new connections.
+ */
+func getCert(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert.mutex.RLock()
+	defer cert.mutex.RUnlock()
+	return cert.current, nil
+}
+
 /* Fire is suppsoed to be run in a separate goroutine, and handles incoming
  * requests on the hlhv port. It decides what those connections are and creates
- * new Cells and Bands out of them. This function will only run after the
+ * new Cells and Bands out of them. Connections log in concurrently, so a slow
+ * one does not hold up the others. This function will only run after the
  * wrangler has been Arm()'d.
  */
 func Fire() {
@@ -98,14 +218,7 @@ func Fire() {
 		}
 
 		scribe.PrintConnect(scribe.LogLevelNormal, "new connection")
-		err = handleConn(conn)
-
-		if err != nil {
-			scribe.PrintError(
-				scribe.LogLevelError,
-				"wrangler accept:", err)
-			continue
-		}
+		handshake(conn)
 	}
 }
 
@@ -150,7 +263,7 @@ func handleConn(conn net.Conn) (err error) {
 			"cell sent strange kind code: ", kind))
 	}
 
-	frame := protocol.FrameIAm{}
+	frame := cells.FrameIAm{}
 	err = json.Unmarshal(data, &frame)
 	if err != nil {
 		conn.Close()
@@ -159,9 +272,23 @@ func handleConn(conn net.Conn) (err error) {
 			"error unmarshaling login frame: ", err.Error()))
 	}
 
+	// the tls handshake is done by now, so the client certificate, if
+	// any, has been checked. a certificate that was checked but does not
+	// say who the cell is cannot be used to log in, and it must not be
+	// mistaken for no certificate at all.
+	certId, verified := certIdentity(conn)
+	if verified && certId == "" {
+		conn.Close()
+		scribe.PrintDisconnect(scribe.LogLevelNormal, "kicked")
+		return errors.New(
+			"client certificate has no common name or DNS name")
+	}
+
 	switch frame.ConnKind {
 	case protocol.ConnKindCell:
-		err = handleConnCell(conn, reader, writer, frame.Key)
+		err = handleConnCell(
+			conn, reader, writer,
+			frame.Key, frame.Name, certId, frame.Features)
 		if err != nil {
 			conn.Close()
 			scribe.PrintDisconnect(scribe.LogLevelNormal, "kicked")
@@ -170,7 +297,9 @@ func handleConn(conn net.Conn) (err error) {
 		scribe.PrintDone(scribe.LogLevelNormal, "accepted cell")
 		break
 	case protocol.ConnKindBand:
-		err = handleConnBand(conn, reader, writer, frame.Uuid, frame.Key)
+		err = handleConnBand(
+			conn, reader, writer,
+			frame.Uuid, frame.Key, certId)
 		if err != nil {
 			conn.Close()
 			scribe.PrintDisconnect(scribe.LogLevelNormal, "kicked")
@@ -194,11 +323,34 @@ func handleConnCell(
 	reader *fsock.Reader,
 	writer *fsock.Writer,
 	key string,
+	name string,
+	certId string,
+	features []string,
 ) (
 	err error,
 ) {
 	bumpTimeout(leash)
 
+	// when client certificates are required, a key is never enough
+	cert.mutex.RLock()
+	required := cert.clientAuth == tls.RequireAndVerifyClientCert
+	cert.mutex.RUnlock()
+	if required && certId == "" {
+		return errors.New("cell did not present a client certificate")
+	}
+
+	// a client certificate takes the place of a key
+	identity, credential := certId, conf.CertCredential
+	if certId == "" {
+		identity, credential, err = conf.CheckCellKey(key, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// only use the optional features both sides understand
+	features = cells.Negotiate(features)
+
 	var cell *cells.Cell
 
 	// generate a uuid and slap that hoe into the cell store
@@ -207,12 +359,11 @@ func handleConnCell(
 		uuid := uuid.New()
 		uuidString = uuid.String()
 
-		_, exists := cellStore.lookup[uuidString]
-		if !exists {
-			cell = cells.NewCell(
-				leash, reader, writer,
-				uuidString, cleanUpCell)
-			cellStore.lookup[uuidString] = cell
+		cell = cells.NewCell(
+			leash, reader, writer,
+			uuidString, name, identity, credential,
+			features, cleanUpCell)
+		if cellStore.add(cell) {
 			break
 		}
 
@@ -220,10 +371,17 @@ func handleConnCell(
 	}
 
 	// inform the cell that it has been accepted, and give it the uuid
-	_, err = protocol.WriteMarshalFrame(writer, &protocol.FrameAccept{
-		Uuid: uuidString,
-		Key:  cell.Key(),
-	})
+	accept := &cells.FrameAccept{
+		FrameAccept: protocol.FrameAccept{
+			Uuid: uuidString,
+			Key:  cell.Key(),
+		},
+		Features: features,
+	}
+	if cell.HasFeature(cells.FeatureMux) {
+		accept.MuxWindow = cell.MuxWindow()
+	}
+	_, err = protocol.WriteMarshalFrame(writer, accept)
 	if err != nil {
 		return err
 	}
@@ -231,6 +389,7 @@ func handleConnCell(
 	clearTimeout(leash)
 	go cell.Listen()
 	go cell.ListenSig()
+	go cell.Heartbeat()
 	return nil
 }
 
@@ -246,32 +405,38 @@ func handleConnBand(
 	writer *fsock.Writer,
 	uuid string,
 	key string,
+	certId string,
 ) (
 	err error,
 ) {
 	bumpTimeout(conn)
 
-	cell, exists := cellStore.lookup[uuid]
-	if !exists {
+	cell := cellStore.lookup(uuid)
+	if cell == nil {
 		return errors.New(fmt.Sprint(
 			"error binding band: no cell called", uuid))
 	}
 
+	// bands of a cell that was identified by its certificate must present
+	// a certificate for the same identity
+	if cell.Credential() == conf.CertCredential &&
+		certId != cell.Identity() {
+		return errors.New(fmt.Sprint(
+			"error binding band: certificate does not match cell ",
+			uuid))
+	}
+
 	band := cells.NewBand(conn, reader, writer)
 
-	// add band to cell
+	// add band to cell. this also informs the band that it has been
+	// accepted.
 	err = cell.Bind(band, key)
 	if err != nil {
 		return err
 	}
 
-	// inform the band that it has been accepted
-	_, err = protocol.WriteMarshalFrame(writer, &protocol.FrameAccept{
-		Uuid: uuid,
-	})
-
 	clearTimeout(conn)
-	return err
+	return nil
 }
 
 /* Garden is a goroutine that prunes cells on an interval.
@@ -287,22 +452,45 @@ func Garden() {
 
 		pruned := 0
 		scribe.PrintProgress(scribe.LogLevelDebug, "pruning cell bands")
-		for _, cell := range cellStore.lookup {
+		for _, cell := range cellStore.snapshot() {
 			pruned += cell.Prune()
 		}
 		scribe.PrintDone(scribe.LogLevelDebug, pruned, "bands pruned")
 	}
-	scribe.PrintFatal(
-		scribe.LogLevelError,
-		"gardener has stopped, will not attempt to run without it!")
-	os.Exit(1)
 }
 
 /* This function is called by cells when their leashes close. It removes the
  * cell from the wrangler's list.
  */
 func cleanUpCell(cell *cells.Cell) {
-	delete(cellStore.lookup, cell.Uuid())
+	cellStore.remove(cell)
+}
+
+/* certIdentity returns the identity given by a connection's client certificate,
+ * which is its common name, or its first DNS name if it has no common name. It
+ * returns whether the connection presented a certificate that was checked
+ * against the client CA bundle at all. The identity is empty if there was no
+ * such certificate, or if it has neither a common name nor a DNS name.
+ */
+func certIdentity(conn net.Conn) (identity string, verified bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+
+	leaf := state.PeerCertificates[0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName, true
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0], true
+	}
+	return "", true
 }
 
 /* bumpTimeout sets the read timeout of a connection to however many seconds in